@@ -1,185 +1,207 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/labstack/gommon/log"
-
-	"github.com/sKudryashov/stacksrv/internal/conn"
-	connPkg "github.com/sKudryashov/stacksrv/internal/conn"
-	"github.com/sKudryashov/stacksrv/internal/handler"
+	"github.com/sKudryashov/stacksrv/internal/activation"
+	"github.com/sKudryashov/stacksrv/internal/handover"
+	"github.com/sKudryashov/stacksrv/pkg/config"
 	"github.com/sKudryashov/stacksrv/pkg/logger"
+	"github.com/sKudryashov/stacksrv/pkg/server"
 )
 
-func main() {
-	// go turnOnProf()
-	// defer profile.Start(profile.MemProfile, profile.ProfilePath(".")).Stop()
-	var addr, addrCtrl string
-	flag.StringVar(&addr, "service", ":8080", "service address endpoint")
-	flag.StringVar(&addrCtrl, "control", ":8081", "service address endpoint")
-	flag.Parse()
-	stopCh := make(chan interface{}, 5)
-	stoppedCh := make(chan interface{})
-	restartCh := make(chan interface{})
-
-	var srv *Server
-	srv = NewServer(addr)
+// handoverReadyTimeout is the time a new process gets to start serving
+// before the upgrade is given up
+const handoverReadyTimeout = time.Second * 30
 
-	go startControl(addrCtrl, restartCh)
-	go srv.start(stopCh, stoppedCh)
+func main() {
+	cfg, err := config.Load(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(2)
+	}
+	logger.SetLevel(cfg.Log.Level)
+	inherited, isHandover, err := handover.Inherit()
+	if err != nil {
+		fmt.Println("handover error ", err.Error())
+		os.Exit(1)
+	}
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	termCh := make(chan os.Signal, 1)
+	signal.Notify(termCh, syscall.SIGINT, syscall.SIGTERM)
+	upgradeCh := make(chan os.Signal, 1)
+	signal.Notify(upgradeCh, syscall.SIGUSR2)
+
+	var ls handover.Listeners
+	var restoreFrom func() ([][]byte, error)
+	if isHandover {
+		ls = inherited.Listeners
+		// requests wait for the stack while the old process drains
+		restoreFrom = inherited.ReadState
+		logger.App.Info("listeners inherited, the stack comes once the old process is drained")
+	} else {
+		activated, err := activation.Listeners()
+		if err != nil {
+			fmt.Println("socket activation error ", err.Error())
+			os.Exit(1)
+		}
+		// a socket systemd didn't pass is bound by the server
+		ls.Service, ls.Control = activated[activation.NameService], activated[activation.NameControl]
+	}
+	srv, err := newServer(cfg, ls, nil, restoreFrom, upgradeCh)
+	if err != nil {
+		fmt.Println("server setup error ", err.Error())
+		os.Exit(1)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		fmt.Println("launch error ", err.Error())
+		os.Exit(1)
+	}
+	if isHandover {
+		if err := inherited.Ready(); err != nil {
+			logger.App.Error(err.Error())
+		}
+	}
 
 	for {
 		select {
-		case <-restartCh:
-			logger.App.Info("server restart signal received")
-			stopCh <- struct{}{}
-			logger.App.Info("issued stop signal for the server")
-			srv.lstnr.Close()
-			select {
-			case <-stoppedCh:
-				logger.App.Info("signal server stopped received, ready to restart .. ")
-				srv = NewServer(addr)
-				logger.App.Debug("new srv instance created")
-				go srv.start(stopCh, stoppedCh)
+		case sig := <-termCh:
+			logger.App.Infof("%s received, shutting down", sig)
+			if !shutdown(srv) {
+				os.Exit(1)
+			}
+			logger.App.Info("server is shut down")
+			os.Exit(0)
+		case <-upgradeCh:
+			logger.App.Info("upgrade requested")
+			srv = upgrade(srv, upgradeCh)
+		case <-hupCh:
+			logger.App.Info("SIGHUP received")
+			if srv.Config().TLS.Enabled() {
+				if err := srv.ReloadCerts(); err != nil {
+					logger.App.Errorf("certificate reload failed, keeping the old one: %v", err)
+				}
 			}
+			live, restart, err := srv.ReloadConfig()
+			if err != nil {
+				logger.App.Errorf("config reload failed: %v", err)
+				continue
+			}
+			logger.App.Infof("config reloaded, applied: %s, restart required: %s", strings.Join(live, " "), strings.Join(restart, " "))
 		}
 	}
 }
 
-// Start with start you may either start or restart the server
-func (srv *Server) start(stopCh <-chan interface{}, stoppedCh chan<- interface{}) {
-	readingQueue := make(chan *conn.Conn, conn.MaxConn)
-	stopWorkersCh := make(chan interface{})
-	pool := conn.NewConnPool(stopWorkersCh)
-	tcpHandler := handler.NewTCP(pool)
-	logger.App.Infof("server started on address %s", srv.laddr)
-
-	go tcpHandler.ConnListener(readingQueue, stopWorkersCh)
-	for {
-		select {
-		case <-stopCh:
-			srv.lstnr.Close()
-			logger.App.Info("server stop signal received")
-			close(stopWorkersCh)
-			readingQueue = nil
-			logger.App.Info("closing listeners.. ")
-			//let every worker get its signals
-			time.Sleep(1 * time.Second)
-			stoppedCh <- struct{}{}
-			logger.App.Info("server is stopped")
-			return
-		default:
-		}
-		conn, err := srv.lstnr.AcceptTCP()
-		if err != nil {
-			logger.App.Errorf("failed to accept conn: %", err)
-			if conn != nil {
-				conn.Close()
+// newServer builds the server which serves ls, the listeners which are nil
+// are bound from cfg
+func newServer(cfg *config.Config, ls handover.Listeners, restore [][]byte, restoreFrom func() ([][]byte, error), upgradeCh chan os.Signal) (*server.Server, error) {
+	return server.New(server.Options{
+		Config:          cfg,
+		Listener:        ls.Service,
+		ControlListener: ls.Control,
+		AdminListener:   ls.Admin,
+		MetricsListener: ls.Metrics,
+		PprofListener:   ls.Pprof,
+		Restore:         restore,
+		RestoreFrom:     restoreFrom,
+		LoadConfig: func() (*config.Config, error) {
+			return config.Load(os.Args[0], os.Args[1:])
+		},
+		Upgrade: func() error {
+			select {
+			case upgradeCh <- syscall.SIGUSR2:
+				return nil
+			default:
+				return errors.New("upgrade is already in progress")
 			}
-			continue
-		}
-		logger.App.Infof("accepted tcp from ", conn.RemoteAddr())
-		appConn := &connPkg.Conn{
-			TCPConn: conn,
-		}
-		appConn.SetTime(time.Now().Unix())
-		appConn.SetActive(true)
-		appConn.SetNoDelay(true)
-		pool.TryPush(appConn, readingQueue)
-	}
+		},
+	})
 }
 
-func (srv *Server) stop() {
-	if err := srv.lstnr.Close(); err != nil {
-		panic(" unable to close 1" + err.Error())
+// upgrade hands srv over to a new process started from the binary on disk
+// and exits once it's done. If the new process doesn't get ready srv keeps
+// serving, if it fails after srv is shut down a new server takes the stack
+// and the listeners back. It returns the server to go on with
+func upgrade(srv *server.Server, upgradeCh chan os.Signal) *server.Server {
+	ls := handover.Listeners{}
+	ls.Service, ls.Control = srv.Listeners()
+	ls.Admin, ls.Metrics, ls.Pprof = srv.HTTPListeners()
+	transfer, err := handover.Start(ls)
+	if err != nil {
+		logger.App.Errorf("upgrade failed, keep serving: %v", err)
+		return srv
 	}
-	file, err := srv.lstnr.File()
+	defer transfer.Close()
+	logger.App.Infof("new process %d started, waiting for it to get ready", transfer.Pid())
+	if err := transfer.WaitReady(handoverReadyTimeout); err != nil {
+		transfer.Abort()
+		logger.App.Errorf("upgrade failed, keep serving: %v", err)
+		return srv
+	}
+	logger.App.Info("new process is ready, handing over")
+	drained := shutdown(srv)
+	snapshot, err := srv.Snapshot()
 	if err == nil {
-		file.Close()
-	} else {
-		panic(" unable to close 2" + err.Error())
+		err = transfer.SendState(snapshot)
 	}
-}
-
-// NewServer is a server constructor
-func NewServer(addr string) *Server {
-	resolvedTCPAddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
-		fmt.Println("resolvedTCPAddr error ", err.Error())
-		os.Exit(1)
+		transfer.Abort()
+		logger.App.Errorf("handover failed, serving again: %v", err)
+		next, err := serveAgain(srv.Config(), transfer, snapshot, upgradeCh)
+		if err != nil {
+			logger.App.Errorf("stack is lost: %v", err)
+			os.Exit(1)
+		}
+		return next
 	}
-	listener, err := net.ListenTCP("tcp", resolvedTCPAddr)
-	if err != nil {
-		fmt.Println("launch listener error ", err.Error())
+	if !drained {
 		os.Exit(1)
 	}
-
-	return &Server{
-		lstnr:   listener,
-		tcpAddr: resolvedTCPAddr,
-		laddr:   addr,
-	}
+	logger.App.Info("handover is complete")
+	os.Exit(0)
+	return nil
 }
 
-func startControl(addrCtrl string, restartCh chan<- interface{}) {
-	laddr, err := net.ResolveTCPAddr("tcp", addrCtrl)
-	l, err := net.ListenTCP("tcp", laddr)
+// serveAgain starts a new server on the listeners passed to the failed new
+// process, with the stack it didn't get
+func serveAgain(cfg *config.Config, transfer *handover.Transfer, snapshot [][]byte, upgradeCh chan os.Signal) (*server.Server, error) {
+	ls, err := transfer.Listeners()
 	if err != nil {
-		fmt.Println("launch error ", err.Error())
-		os.Exit(1)
+		return nil, err
 	}
-	for {
-		logger.Control.Infof("ready to accept control commands on addr %s", addrCtrl)
-		conn, err := l.AcceptTCP()
-		if err != nil {
-			logger.Control.Errorf("failed to accept conn: %", err)
-			conn.Close()
-			continue
-		}
-		conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
-		conn.SetKeepAlive(false)
-		data := make([]byte, 3)
-		if _, err := conn.Read(data); err != nil {
-			logger.Control.Errorf("unable to read conn %v", err)
-		}
-		conn.Close()
-		logger.Control.Infof("accepted tcp from ", conn.RemoteAddr())
-		if string(data) == "rel" {
-			restartCh <- struct{}{}
-		}
+	srv, err := newServer(cfg, ls, snapshot, nil, upgradeCh)
+	if err != nil {
+		ls.Close()
+		return nil, err
 	}
+	if err := srv.Start(context.Background()); err != nil {
+		ls.Close()
+		return nil, err
+	}
+	return srv, nil
 }
 
-type Server struct {
-	lstnr   *net.TCPListener
-	tcpAddr *net.TCPAddr
-	laddr   string
-}
-
-func getLogLVL() log.Lvl {
-	lvl := os.Getenv("LOG_LEVEL")
-	switch lvl {
-	case "info":
-		return log.INFO
-	case "error":
-		return log.ERROR
-	default:
-		return log.DEBUG
+// shutdown shuts srv down within the configured grace period, it returns
+// false if requests are still in flight by then
+func shutdown(srv *server.Server) bool {
+	grace := srv.Config().Service.ShutdownGrace.Duration
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.App.Errorf("requests are still in flight after %s, exiting anyway", grace)
+		return false
 	}
+	return true
 }
-
-// func turnOnProf() {
-// 	r := http.NewServeMux()
-// 	runtime.SetBlockProfileRate(1)
-// 	r.HandleFunc("/debug/pprof/", pprof.Index)
-// 	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-// 	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
-// 	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-// 	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
-
-// 	http.ListenAndServe(":8090", r)
-// }
@@ -4,6 +4,5 @@ go 1.14
 
 require (
 	github.com/davecgh/go-spew v1.1.0
-	github.com/labstack/gommon v0.3.0
 	github.com/pkg/profile v1.5.0
 )
@@ -0,0 +1,101 @@
+package activation
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sKudryashov/stacksrv/internal/sockets"
+)
+
+// listenFdsStart is the first descriptor passed by systemd
+const listenFdsStart = 3
+
+// socket names matched against FileDescriptorName= of the socket units
+const (
+	NameService = "service"
+	NameControl = "control"
+)
+
+// Listeners returns the listeners passed by systemd socket activation keyed by
+// name, an empty map means the process isn't socket activated. Without
+// LISTEN_FDNAMES the first socket is the service one and the second is the
+// control one
+func Listeners() (map[string]*net.TCPListener, error) {
+	defer unsetEnv()
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return map[string]*net.TCPListener{}, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("malformed LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+	fds, err := assign(n, names)
+	if err != nil {
+		return nil, err
+	}
+	return listen(fds)
+}
+
+// listen returns listeners on fds keyed by name, made in descriptor order. If
+// one fails the ones already made are closed
+func listen(fds map[string]uintptr) (map[string]*net.TCPListener, error) {
+	names := make([]string, 0, len(fds))
+	for name := range fds {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return fds[names[i]] < fds[names[j]] })
+	listeners := make(map[string]*net.TCPListener, len(fds))
+	for _, name := range names {
+		l, err := sockets.FromFd(fds[name], name)
+		if err != nil {
+			for _, made := range listeners {
+				made.Close()
+			}
+			return nil, err
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
+
+// assign maps socket names to descriptors
+func assign(n int, names []string) (map[string]uintptr, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("malformed LISTEN_FDS %d", n)
+	}
+	if names == nil {
+		names = []string{NameService, NameControl}
+		if n < len(names) {
+			names = names[:n]
+		}
+	}
+	if len(names) != n {
+		return nil, fmt.Errorf("%d sockets passed but %d names", n, len(names))
+	}
+	fds := make(map[string]uintptr, n)
+	for i, name := range names {
+		if name != NameService && name != NameControl {
+			return nil, fmt.Errorf("unknown socket name %q, %s or %s expected", name, NameService, NameControl)
+		}
+		if _, ok := fds[name]; ok {
+			return nil, fmt.Errorf("socket %s passed twice", name)
+		}
+		fds[name] = uintptr(listenFdsStart + i)
+	}
+	return fds, nil
+}
+
+// unsetEnv keeps the variables from children, the upgrade one in particular
+func unsetEnv() {
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+}
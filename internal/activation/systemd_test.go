@@ -0,0 +1,85 @@
+package activation
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAssign(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       int
+		names   []string
+		want    map[string]uintptr
+		wantErr bool
+	}{
+		{"no sockets", 0, nil, map[string]uintptr{}, false},
+		{"service only", 1, nil, map[string]uintptr{NameService: 3}, false},
+		{"by order", 2, nil, map[string]uintptr{NameService: 3, NameControl: 4}, false},
+		{"by name", 2, []string{NameControl, NameService}, map[string]uintptr{NameService: 4, NameControl: 3}, false},
+		{"control only", 1, []string{NameControl}, map[string]uintptr{NameControl: 3}, false},
+		{"too many unnamed", 3, nil, nil, true},
+		{"names mismatch", 2, []string{NameService}, nil, true},
+		{"unknown name", 1, []string{"admin"}, nil, true},
+		{"duplicate name", 2, []string{NameService, NameService}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := assign(tt.n, tt.names)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("assign() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("assign() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// dupFd returns a copy of the descriptor of f which the caller owns
+func dupFd(t *testing.T, f *os.File) uintptr {
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatalf("Dup() error = %v", err)
+	}
+	return uintptr(fd)
+}
+
+func TestListen_closesOnError(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen error = %v", err)
+	}
+	lnFile, err := ln.File()
+	if err != nil {
+		t.Fatalf("File() error = %v", err)
+	}
+	regular, err := ioutil.TempFile("", "activation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(regular.Name())
+	defer regular.Close()
+	service, control := dupFd(t, lnFile), dupFd(t, regular)
+	lnFile.Close()
+	// the service socket comes first, so it's made before the control one fails
+	if service > control {
+		t.Skip("descriptors aren't in the order the test needs")
+	}
+
+	if _, err := listen(map[string]uintptr{NameService: service, NameControl: control}); err == nil {
+		t.Fatalf("listen() on a regular file succeeded")
+	}
+	// with every copy closed nothing accepts on the address anymore
+	addr := ln.Addr().String()
+	ln.Close()
+	if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		c.Close()
+		t.Errorf("service listener is left open after the failure")
+	}
+}
@@ -0,0 +1,167 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Operations recorded in the audit log
+const (
+	OpPush    = "push"
+	OpPop     = "pop"
+	OpClear   = "clear"
+	OpRestore = "restore"
+)
+
+// Entry is a single stack mutation. Push and pop entries are made by a
+// client connection and describe one payload, clear and restore ones are made
+// by the server and describe Items items at once
+type Entry struct {
+	Time   time.Time `json:"time"`
+	ConnID int       `json:"conn_id,omitempty"`
+	Remote string    `json:"remote,omitempty"`
+	Op     string    `json:"op"`
+	Len    int       `json:"len"`
+	SHA256 string    `json:"sha256,omitempty"`
+	Items  int       `json:"items,omitempty"`
+}
+
+// NewEntry returns the entry of a client operation on payload
+func NewEntry(op string, connID int, remote string, payload []byte) Entry {
+	sum := sha256.Sum256(payload)
+	return Entry{
+		Time:   time.Now().UTC(),
+		ConnID: connID,
+		Remote: remote,
+		Op:     op,
+		Len:    len(payload),
+		SHA256: hex.EncodeToString(sum[:]),
+	}
+}
+
+// Log is an append-only file of JSON entries, one per line. Once the file
+// would grow over maxSize it's renamed to path.1, path.1 to path.2 and so on,
+// and files past maxFiles are removed. It's safe for concurrent use
+type Log struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+// Open opens the audit log at path for appending, maxSize is the file size in
+// bytes to rotate at and maxFiles is the number of rotated files to keep
+func Open(path string, maxSize int64, maxFiles int) (*Log, error) {
+	l := &Log{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open audit log %s: %v", l.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to stat audit log %s: %v", l.path, err)
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// Record appends e to the log, rotating it first if e doesn't fit. If the
+// rotation fails e is appended to the current file and the rotation is tried
+// again by the next entry
+func (l *Log) Record(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("unable to encode audit entry: %v", err)
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return fmt.Errorf("audit log %s is closed", l.path)
+	}
+	var rotateErr error
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		rotateErr = l.rotate()
+		if l.f == nil {
+			return rotateErr
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("unable to write audit log %s: %v", l.path, err)
+	}
+	return rotateErr
+}
+
+// rotate closes the current file, shifts the rotated files and opens the
+// file at path again: a new one, or the same one if shifting failed. l.f is
+// nil only if it can't be opened
+func (l *Log) rotate() error {
+	cerr := l.f.Close()
+	l.f = nil
+	err := l.shift()
+	if oerr := l.open(); oerr != nil {
+		return oerr
+	}
+	if err == nil && cerr != nil {
+		err = fmt.Errorf("unable to close audit log %s: %v", l.path, cerr)
+	}
+	return err
+}
+
+// shift shifts the rotated files by one and drops the ones past maxFiles
+func (l *Log) shift() error {
+	if err := os.Remove(l.rotated(l.maxFiles)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove old audit log: %v", err)
+	}
+	for i := l.maxFiles - 1; i >= 0; i-- {
+		if err := os.Rename(l.rotated(i), l.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to rotate audit log: %v", err)
+		}
+	}
+	return nil
+}
+
+// rotated returns the name of the i-th rotated file, 0 is the current one
+func (l *Log) rotated(i int) string {
+	if i == 0 {
+		return l.path
+	}
+	return l.path + "." + strconv.Itoa(i)
+}
+
+// Close flushes and closes the file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Sync()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readEntries(t *testing.T, path string) []Entry {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unable to open %s: %v", path, err)
+	}
+	defer f.Close()
+	var entries []Entry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("line %q isn't an entry: %v", sc.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestNewEntry(t *testing.T) {
+	e := NewEntry(OpPush, 3, "127.0.0.1:5000", []byte("abc"))
+	if e.Len != 3 || e.ConnID != 3 || e.Remote != "127.0.0.1:5000" || e.Op != OpPush {
+		t.Errorf("NewEntry() = %+v", e)
+	}
+	// sha256 of "abc"
+	if want := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"; e.SHA256 != want {
+		t.Errorf("SHA256 = %s, want %s", e.SHA256, want)
+	}
+}
+
+func TestLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	line, _ := json.Marshal(NewEntry(OpPop, 1, "", nil))
+
+	tests := []struct {
+		name     string
+		entries  int
+		maxFiles int
+		want     []int
+	}{
+		// a file fits two entries, entries beyond the kept files are lost
+		{"two rotated files", 7, 2, []int{1, 2, 2}},
+		{"no rotated files", 5, 0, []int{1}},
+		{"no rotation", 2, 2, []int{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.RemoveAll(dir)
+			os.Mkdir(dir, 0700)
+			// time length varies a bit as trailing zeros are dropped
+			l, err := Open(path, int64(2*(len(line)+1)+20), tt.maxFiles)
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			for i := 0; i < tt.entries; i++ {
+				if err := l.Record(NewEntry(OpPop, i+1, "", nil)); err != nil {
+					t.Fatalf("Record() error = %v", err)
+				}
+			}
+			if err := l.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			// the newest entries are in path, older ones in path.1 and so on
+			id := tt.entries
+			for i, n := range tt.want {
+				entries := readEntries(t, l.rotated(i))
+				if len(entries) != n {
+					t.Fatalf("file %d has %d entries, want %d", i, len(entries), n)
+				}
+				for j := n - 1; j >= 0; j-- {
+					if entries[j].ConnID != id {
+						t.Errorf("file %d entry %d conn id = %d, want %d", i, j, entries[j].ConnID, id)
+					}
+					id--
+				}
+			}
+			if _, err := os.Stat(l.rotated(len(tt.want))); !os.IsNotExist(err) {
+				t.Errorf("file %d is kept, want it removed", len(tt.want))
+			}
+		})
+	}
+}
+
+func TestLogRotationFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	// a non-empty directory in place of the oldest rotated file can't be
+	// removed, so rotation fails
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	l, err := Open(path, 1, 1)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer l.Close()
+	if err := l.Record(NewEntry(OpPush, 1, "", nil)); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+	if err := l.Record(NewEntry(OpPush, 2, "", nil)); err == nil {
+		t.Fatalf("Record() with a failed rotation succeeded")
+	}
+	// the log goes on in the current file and rotates once it's possible
+	os.RemoveAll(path + ".1")
+	if err := l.Record(NewEntry(OpPush, 3, "", nil)); err != nil {
+		t.Fatalf("Record() after the failure error = %v", err)
+	}
+	if entries := readEntries(t, l.rotated(1)); len(entries) != 2 || entries[1].ConnID != 2 {
+		t.Errorf("rotated file has %+v, want entries 1 and 2", entries)
+	}
+	if entries := readEntries(t, path); len(entries) != 1 || entries[0].ConnID != 3 {
+		t.Errorf("current file has %+v, want entry 3", entries)
+	}
+}
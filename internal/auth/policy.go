@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/sKudryashov/stacksrv/internal/service/formatter"
+)
+
+const (
+	// PermPushOnly allows push requests only
+	PermPushOnly = "push-only"
+	// PermPopOnly allows pop requests only
+	PermPopOnly = "pop-only"
+	// PermAdmin allows every operation
+	PermAdmin = "admin"
+)
+
+// Policy maps client identities to the operations they are allowed to run
+type Policy struct {
+	// Identities maps identity (client certificate subject CN) to a permission
+	Identities map[string]string `json:"identities"`
+	// Default is applied to identities missing in the map, empty means deny
+	Default string `json:"default"`
+}
+
+// LoadPolicy reads and validates a JSON policy file
+func LoadPolicy(path string) (*Policy, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read policy file %s: %v", path, err)
+	}
+	p := &Policy{}
+	if err := json.Unmarshal(raw, p); err != nil {
+		return nil, fmt.Errorf("unable to parse policy file %s: %v", path, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %v", path, err)
+	}
+	return p, nil
+}
+
+// Validate checks that every permission is a known one
+func (p *Policy) Validate() error {
+	if p.Default != "" && !isKnownPerm(p.Default) {
+		return fmt.Errorf("unknown default permission %q", p.Default)
+	}
+	for id, perm := range p.Identities {
+		if !isKnownPerm(perm) {
+			return fmt.Errorf("unknown permission %q for identity %q", perm, id)
+		}
+	}
+	return nil
+}
+
+// Allowed returns whether identity may run the given action
+func (p *Policy) Allowed(identity, action string) bool {
+	perm, ok := p.Identities[identity]
+	if !ok {
+		perm = p.Default
+	}
+	switch perm {
+	case PermAdmin:
+		return true
+	case PermPushOnly:
+		return action == formatter.ActionPush
+	case PermPopOnly:
+		return action == formatter.ActionPop
+	default:
+		return false
+	}
+}
+
+func isKnownPerm(perm string) bool {
+	switch perm {
+	case PermPushOnly, PermPopOnly, PermAdmin:
+		return true
+	}
+	return false
+}
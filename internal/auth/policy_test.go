@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/sKudryashov/stacksrv/internal/service/formatter"
+)
+
+func TestPolicy_Allowed(t *testing.T) {
+	p := &Policy{
+		Identities: map[string]string{
+			"producer": PermPushOnly,
+			"consumer": PermPopOnly,
+			"ops":      PermAdmin,
+		},
+	}
+	tests := []struct {
+		name     string
+		identity string
+		action   string
+		allowed  bool
+	}{
+		{name: "push-only pushes", identity: "producer", action: formatter.ActionPush, allowed: true},
+		{name: "push-only pops", identity: "producer", action: formatter.ActionPop, allowed: false},
+		{name: "pop-only pops", identity: "consumer", action: formatter.ActionPop, allowed: true},
+		{name: "pop-only pushes", identity: "consumer", action: formatter.ActionPush, allowed: false},
+		{name: "admin pushes", identity: "ops", action: formatter.ActionPush, allowed: true},
+		{name: "admin pops", identity: "ops", action: formatter.ActionPop, allowed: true},
+		{name: "unknown denied", identity: "stranger", action: formatter.ActionPop, allowed: false},
+		{name: "anonymous denied", identity: "", action: formatter.ActionPush, allowed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.Allowed(tt.identity, tt.action); got != tt.allowed {
+				t.Fatalf("Allowed(%q, %s) = %v, expected %v", tt.identity, tt.action, got, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestPolicy_Validate(t *testing.T) {
+	p := &Policy{Identities: map[string]string{"a": "read-write"}}
+	if err := p.Validate(); err == nil {
+		t.Fatalf("expected unknown permission error")
+	}
+	p = &Policy{Default: PermPopOnly}
+	if err := p.Validate(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !p.Allowed("anyone", formatter.ActionPop) {
+		t.Fatalf("default permission isn't applied")
+	}
+}
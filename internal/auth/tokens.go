@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// MaxTokenLen is the longest token an auth frame can carry
+const MaxTokenLen = 127
+
+type tokenEntry struct {
+	identity string
+	sum      [sha256.Size]byte
+}
+
+// Tokens holds shared-secret tokens clients authenticate with
+type Tokens struct {
+	entries []tokenEntry
+}
+
+// LoadTokens reads a token file, every non-empty line which doesn't start with #
+// is either "<token>" or "<identity> <token>"
+func LoadTokens(path string) (*Tokens, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token file %s: %v", path, err)
+	}
+	t := &Tokens{}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		var identity, token string
+		switch len(fields) {
+		case 1:
+			identity, token = "token", fields[0]
+		case 2:
+			identity, token = fields[0], fields[1]
+		default:
+			return nil, fmt.Errorf("token file %s line %d: expected \"[identity] token\"", path, n)
+		}
+		if len(token) > MaxTokenLen {
+			return nil, fmt.Errorf("token file %s line %d: token is longer than %d bytes", path, n, MaxTokenLen)
+		}
+		t.entries = append(t.entries, tokenEntry{identity: identity, sum: sha256.Sum256([]byte(token))})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read token file %s: %v", path, err)
+	}
+	if len(t.entries) == 0 {
+		return nil, fmt.Errorf("token file %s has no tokens", path)
+	}
+	return t, nil
+}
+
+// Validate checks the token against every configured one in constant time and
+// returns the identity bound to it
+func (t *Tokens) Validate(token []byte) (string, bool) {
+	sum := sha256.Sum256(token)
+	identity := ""
+	found := 0
+	// no early exit, every entry is compared regardless of a match
+	for _, e := range t.entries {
+		match := subtle.ConstantTimeCompare(sum[:], e.sum[:])
+		if match == 1 && found == 0 {
+			identity = e.identity
+		}
+		found |= match
+	}
+	return identity, found == 1
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTokens_Validate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens")
+	content := "# comment\n\nproducer s3cret\nanonymous-token\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := LoadTokens(path)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	tests := []struct {
+		name     string
+		token    string
+		identity string
+		ok       bool
+	}{
+		{name: "named token", token: "s3cret", identity: "producer", ok: true},
+		{name: "bare token", token: "anonymous-token", identity: "token", ok: true},
+		{name: "wrong token", token: "s3cre", ok: false},
+		{name: "empty token", token: "", ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, ok := tokens.Validate([]byte(tt.token))
+			if ok != tt.ok || identity != tt.identity {
+				t.Fatalf("Validate(%q) = %q %v, expected %q %v", tt.token, identity, ok, tt.identity, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/sKudryashov/stacksrv/pkg/logger"
+)
+
+// Reloader keeps the current server certificate and swaps it on Reload, so
+// handshakes started after a reload pick up the new pair while established
+// connections keep working
+type Reloader struct {
+	mu       sync.RWMutex
+	certPath string
+	keyPath  string
+	cert     *tls.Certificate
+	log      logger.Logger
+}
+
+// NewReloader a Reloader constructor, it loads the pair once and fails if it
+// can't. Loaded pairs are logged to log
+func NewReloader(certPath, keyPath string, log logger.Logger) (*Reloader, error) {
+	r := &Reloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+		log:      log,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the certificate and the key from disk, on failure the
+// previously loaded pair stays in use
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("unable to load key pair %s %s: %v", r.certPath, r.keyPath, err)
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	r.log.Infof("tls certificate loaded from %s", r.certPath)
+	return nil
+}
+
+// GetCertificate is a tls.Config.GetCertificate callback
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	cert := r.cert
+	r.mu.RUnlock()
+	return cert, nil
+}
+
+// TLSConfig returns a server tls config backed by the reloader
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// LoadClientCAs reads a PEM bundle of CAs trusted to sign client certificates
+func LoadClientCAs(path string) (*x509.CertPool, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client CA file %s: %v", path, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", path)
+	}
+	return pool, nil
+}
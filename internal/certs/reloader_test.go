@@ -0,0 +1,164 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sKudryashov/stacksrv/pkg/logger"
+)
+
+// writePair writes a self-signed certificate for cn and its key to dir as
+// <name>.crt and <name>.key and returns their paths
+func writePair(t *testing.T, dir, name, cn string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey() error = %v", err)
+	}
+	certPath, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+// servedCN returns the common name of the certificate r serves
+func servedCN(t *testing.T, r *Reloader) string {
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetCertificate() error = %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("served certificate is malformed: %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func copyFile(t *testing.T, from, to string) {
+	raw, err := ioutil.ReadFile(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(to, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloader_Reload(t *testing.T) {
+	tests := []struct {
+		name string
+		// replace puts the new files in place of the loaded ones
+		replace func(t *testing.T, dir, certPath, keyPath string)
+		wantErr bool
+		wantCN  string
+	}{
+		{
+			name: "new pair",
+			replace: func(t *testing.T, dir, certPath, keyPath string) {
+				newCert, newKey := writePair(t, dir, "new", "new")
+				copyFile(t, newCert, certPath)
+				copyFile(t, newKey, keyPath)
+			},
+			wantCN: "new",
+		},
+		{
+			name: "garbage certificate",
+			replace: func(t *testing.T, dir, certPath, keyPath string) {
+				ioutil.WriteFile(certPath, []byte("not a certificate"), 0600)
+			},
+			wantErr: true,
+			wantCN:  "old",
+		},
+		{
+			name: "key of another certificate",
+			replace: func(t *testing.T, dir, certPath, keyPath string) {
+				_, newKey := writePair(t, dir, "new", "new")
+				copyFile(t, newKey, keyPath)
+			},
+			wantErr: true,
+			wantCN:  "old",
+		},
+		{
+			name: "missing key",
+			replace: func(t *testing.T, dir, certPath, keyPath string) {
+				os.Remove(keyPath)
+			},
+			wantErr: true,
+			wantCN:  "old",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "certs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			certPath, keyPath := writePair(t, dir, "server", "old")
+			r, err := NewReloader(certPath, keyPath, logger.App)
+			if err != nil {
+				t.Fatalf("NewReloader() error = %v", err)
+			}
+			tt.replace(t, dir, certPath, keyPath)
+			if err := r.Reload(); (err != nil) != tt.wantErr {
+				t.Errorf("Reload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if cn := servedCN(t, r); cn != tt.wantCN {
+				t.Errorf("served certificate CN = %q, want %q", cn, tt.wantCN)
+			}
+		})
+	}
+}
+
+func TestNewReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writePair(t, dir, "server", "server")
+	tests := []struct {
+		name     string
+		certPath string
+		keyPath  string
+		wantErr  bool
+	}{
+		{"valid pair", certPath, keyPath, false},
+		{"missing certificate", filepath.Join(dir, "none.crt"), keyPath, true},
+		{"key as certificate", keyPath, keyPath, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewReloader(tt.certPath, tt.keyPath, logger.App); (err != nil) != tt.wantErr {
+				t.Errorf("NewReloader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -3,54 +3,82 @@ package conn
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"io"
 	"net"
-	"os"
-	"strconv"
 	"sync"
 	"time"
 
 	"github.com/sKudryashov/stacksrv/internal/service/formatter"
+	"github.com/sKudryashov/stacksrv/internal/trace"
+	"github.com/sKudryashov/stacksrv/pkg/logger"
 )
 
 const (
-	// ConnExpiration is a time in seconds after which conn has to be evicted from the
-	// pool and closed
-	ConnExpiration = 10
-	// MaxConnDefault represents max connection per pool
-	MaxConnDefault        = 100
 	connCheckDeadline     = time.Millisecond * 10
 	connCollectorInterval = time.Millisecond * 500
+	// rejectTimeout bounds the TLS handshake and the write of a response to
+	// a connection turned away before it's pooled
+	rejectTimeout = time.Second * 5
 )
 
-// MaxConn represents actual stack name
-var MaxConn int
-
-func init() {
-	s, err := strconv.Atoi(os.Getenv("CONN_POOL_SIZE"))
-	if err != nil {
-		MaxConn = MaxConnDefault
-	}
-	MaxConn = s
-	if MaxConn == 0 {
-		panic("MaxConn can't be 0")
-	}
-}
-
 //Conn represents app wrapper for TCP connection
 type Conn struct {
 	err error
 	*net.TCPConn
+	tlsConn   *tls.Conn
+	identity  string
 	action    string
 	mu        sync.RWMutex
 	time      int64
+	lastRead  int64
+	bytesRead int64
+	state     State
 	id        int
 	data      []byte
 	active    bool
+	log       logger.Logger
+	tr        *trace.Trace
+	// admission releases the pool admission, it's set while the request is
+	// admitted but not blocked yet
+	admission func()
 	Ctx       context.Context
 	CancelCtx func()
 }
 
+// SetLogger sets the logger every line about the connection goes to, it's
+// expected to carry the connection ID
+func (c *Conn) SetLogger(l logger.Logger) {
+	c.mu.Lock()
+	c.log = l
+	c.mu.Unlock()
+}
+
+// Log returns the connection logger, the application one if it's not set
+func (c *Conn) Log() logger.Logger {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.log == nil {
+		return logger.App
+	}
+	return c.log
+}
+
+// SetTrace sets the trace of the request, it's finished once the conn is
+// closed
+func (c *Conn) SetTrace(tr *trace.Trace) {
+	c.mu.Lock()
+	c.tr = tr
+	c.mu.Unlock()
+}
+
+// Trace returns the trace of the request, nil if it isn't traced
+func (c *Conn) Trace() *trace.Trace {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tr
+}
+
 // SetErr sets current error
 func (c *Conn) SetErr(err error) {
 	c.mu.Lock()
@@ -66,13 +94,101 @@ func (c *Conn) GetErr() error {
 	return err
 }
 
+// RemoteIP returns the client address without port, nil if it isn't known
+func (c *Conn) RemoteIP() net.IP {
+	if c.TCPConn == nil {
+		return nil
+	}
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// Remote returns the client address, empty if it isn't known
+func (c *Conn) Remote() string {
+	if c.TCPConn == nil {
+		return ""
+	}
+	return c.RemoteAddr().String()
+}
+
+// SetTLS makes the connection talk TLS on top of the underlying TCP conn, the
+// handshake itself is deferred until Handshake or the first Read/Write
+func (c *Conn) SetTLS(cfg *tls.Config) {
+	c.tlsConn = tls.Server(c.TCPConn, cfg)
+}
+
+// Handshake runs the TLS handshake bounded by its own timeout, so it doesn't
+// eat into request read deadlines. It does nothing for plain connections
+func (c *Conn) Handshake(timeout time.Duration) error {
+	if c.tlsConn == nil {
+		return nil
+	}
+	c.TCPConn.SetDeadline(time.Now().Add(timeout))
+	err := c.tlsConn.Handshake()
+	c.TCPConn.SetDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	// verified client certificate subject becomes the connection identity
+	if peers := c.tlsConn.ConnectionState().PeerCertificates; len(peers) > 0 {
+		id := peers[0].Subject.CommonName
+		if id == "" {
+			id = peers[0].Subject.String()
+		}
+		c.SetIdentity(id)
+	}
+	return nil
+}
+
+// SetIdentity sets authenticated client identity
+func (c *Conn) SetIdentity(id string) {
+	c.mu.Lock()
+	c.identity = id
+	c.mu.Unlock()
+}
+
+// GetIdentity returns authenticated client identity, empty if unknown
+func (c *Conn) GetIdentity() string {
+	c.mu.RLock()
+	id := c.identity
+	c.mu.RUnlock()
+	return id
+}
+
+// Read reads from TLS session if any, otherwise from TCP conn
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.tlsConn != nil {
+		return c.tlsConn.Read(b)
+	}
+	return c.TCPConn.Read(b)
+}
+
+// Write writes to TLS session if any, otherwise to TCP conn
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.tlsConn != nil {
+		return c.tlsConn.Write(b)
+	}
+	return c.TCPConn.Write(b)
+}
+
+func (c *Conn) closeTransport() error {
+	if c.tlsConn != nil {
+		return c.tlsConn.Close()
+	}
+	return c.TCPConn.Close()
+}
+
 //CloseL is a concurrency unsafe wrapper for closing conn
 func (c *Conn) CloseL() error {
 	c.active = false
-	err := c.TCPConn.Close()
+	c.releaseAdmission()
+	err := c.closeTransport()
 	if c.CancelCtx != nil {
 		c.CancelCtx()
 	}
+	c.tr.Finish()
 	return err
 }
 
@@ -80,11 +196,14 @@ func (c *Conn) CloseL() error {
 func (c *Conn) Close() error {
 	c.mu.Lock()
 	c.active = false
+	tr := c.tr
 	c.mu.Unlock()
-	err := c.TCPConn.Close()
+	c.releaseAdmission()
+	err := c.closeTransport()
 	if c.CancelCtx != nil {
 		c.CancelCtx()
 	}
+	tr.Finish()
 	return err
 }
 
@@ -102,6 +221,94 @@ func (c *Conn) SetTime(time int64) {
 	c.mu.Unlock()
 }
 
+// GetTime returns conn time
+func (c *Conn) GetTime() int64 {
+	c.mu.RLock()
+	t := c.time
+	c.mu.RUnlock()
+	return t
+}
+
+// Age returns how long the connection is in the pool
+func (c *Conn) Age(now time.Time) time.Duration {
+	return now.Sub(time.Unix(c.GetTime(), 0))
+}
+
+// CountRead records that n more bytes have just been read from the client
+func (c *Conn) CountRead(n int) {
+	c.mu.Lock()
+	c.lastRead = time.Now().UnixNano()
+	c.bytesRead += int64(n)
+	c.mu.Unlock()
+}
+
+// BytesRead returns how many bytes were read from the client
+func (c *Conn) BytesRead() int64 {
+	c.mu.RLock()
+	n := c.bytesRead
+	c.mu.RUnlock()
+	return n
+}
+
+// Idle returns how long nothing was read from the client
+func (c *Conn) Idle(now time.Time) time.Duration {
+	c.mu.RLock()
+	last := time.Unix(0, c.lastRead)
+	if c.lastRead == 0 {
+		last = time.Unix(c.time, 0)
+	}
+	c.mu.RUnlock()
+	return now.Sub(last)
+}
+
+// GetState returns conn state
+func (c *Conn) GetState() State {
+	c.mu.RLock()
+	s := c.state
+	c.mu.RUnlock()
+	return s
+}
+
+func (c *Conn) setState(s State) {
+	c.mu.Lock()
+	c.state = s
+	c.mu.Unlock()
+}
+
+// MarkReadingBody marks that the header is parsed and the payload is being read
+func (c *Conn) MarkReadingBody() {
+	c.setState(StateReadingBody)
+}
+
+// MarkBlocked marks that the request waits on a full or an empty stack
+func (c *Conn) MarkBlocked() {
+	if c.GetAction() == formatter.ActionPush {
+		c.setState(StateBlockedPush)
+	} else {
+		c.setState(StateBlockedPop)
+	}
+	c.releaseAdmission()
+}
+
+// setAdmission sets the func releasing the pool admission
+func (c *Conn) setAdmission(release func()) {
+	c.mu.Lock()
+	c.admission = release
+	c.mu.Unlock()
+}
+
+// releaseAdmission releases the pool admission if there is one, only the
+// first call counts
+func (c *Conn) releaseAdmission() {
+	c.mu.Lock()
+	release := c.admission
+	c.admission = nil
+	c.mu.Unlock()
+	if release != nil {
+		release()
+	}
+}
+
 // SetActive sets action for a connection
 func (c *Conn) SetActive(active bool) {
 	c.mu.Lock()
@@ -193,7 +400,8 @@ func (c *Conn) GetData() []byte {
 
 // WritePushResponse writes push rsp
 func (c *Conn) WritePushResponse() {
-	c.Write([]byte{0})
+	c.setState(StateWriting)
+	c.writeResponse([]byte{formatter.RespOK})
 	c.SetActive(false)
 	c.Close()
 }
@@ -207,13 +415,61 @@ func (c *Conn) WriteErr() {
 
 // WriteBusyState writes busy queue response
 func (c *Conn) WriteBusyState() {
-	c.Write([]byte{0xFF})
+	c.Write([]byte{formatter.RespBusy})
+}
+
+// Reject writes code and closes the conn in its own goroutine, so a TLS
+// client which never finishes the handshake doesn't hold up the caller
+func (c *Conn) Reject(code byte) {
+	go func() {
+		defer c.Close()
+		if err := c.Handshake(rejectTimeout); err != nil {
+			c.Log().Debugf("unable to reject conn %d: %v", c.GetID(), err)
+			return
+		}
+		c.TCPConn.SetWriteDeadline(time.Now().Add(rejectTimeout))
+		c.Write([]byte{code})
+	}()
+}
+
+// WriteThrottled writes rate limit response code
+func (c *Conn) WriteThrottled(code byte) {
+	c.Write([]byte{code})
+}
+
+// WriteUnauthenticated writes failed authentication response
+func (c *Conn) WriteUnauthenticated() {
+	c.Write([]byte{formatter.RespUnauthenticated})
+}
+
+// WriteShuttingDown writes server shutting down response and closes the conn
+func (c *Conn) WriteShuttingDown() {
+	c.setState(StateWriting)
+	c.writeResponse([]byte{formatter.RespShuttingDown})
+	c.SetActive(false)
+	c.Close()
+}
+
+// WriteDenied writes permission denied response and closes the conn
+func (c *Conn) WriteDenied() {
+	c.Write([]byte{formatter.RespDenied})
+	c.SetActive(false)
+	c.Close()
 }
 
 // WritePopResponse writes pop rsp
 func (c *Conn) WritePopResponse(data []byte) {
 	popRsp := formatter.FormatPopResponse(data)
-	c.Write(popRsp)
+	c.setState(StateWriting)
+	c.writeResponse(popRsp)
 	c.SetActive(false)
 	c.Close()
 }
+
+// writeResponse writes the response of a processed request
+func (c *Conn) writeResponse(b []byte) {
+	tr := c.Trace()
+	tr.Start(trace.SpanWriteResponse)
+	c.Write(b)
+	tr.End(trace.SpanWriteResponse)
+}
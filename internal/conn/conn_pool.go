@@ -2,21 +2,85 @@ package conn
 
 import (
 	"container/list"
+	"errors"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/sKudryashov/stacksrv/internal/service/formatter"
+	"github.com/sKudryashov/stacksrv/internal/tap"
+	"github.com/sKudryashov/stacksrv/internal/trace"
+	"github.com/sKudryashov/stacksrv/pkg/config"
 	"github.com/sKudryashov/stacksrv/pkg/logger"
 )
 
+// Refusals of a connection by the pool
+var (
+	// ErrPoolFull means the pool is full and no connection can be evicted
+	ErrPoolFull = errors.New("pool is full")
+	// ErrOverQuota means the client holds as many slots as its quota allows
+	ErrOverQuota = errors.New("client is over its pool quota")
+)
+
 // NewConnPool a ConnPool constructor
-func NewConnPool(doneCh <-chan interface{}) *ConnPool {
+func NewConnPool(doneCh <-chan interface{}, cfg config.Pool) (*ConnPool, error) {
+	eviction, err := NewEvictionPolicy(cfg.Eviction, cfg.Expiration.Duration)
+	if err != nil {
+		return nil, err
+	}
+	quota, err := NewQuota(cfg.IPLimit, cfg.CIDRLimits)
+	if err != nil {
+		return nil, err
+	}
 	cp := &ConnPool{
 		doneCh:   doneCh,
 		connList: list.New(),
-		list:     make([]*Conn, 0, MaxConn),
+		list:     make([]*Conn, 0, cfg.Size),
+		maxConn:  cfg.Size,
+		quota:    quota,
+		eviction: eviction,
+		reserve:  Reserve{Push: cfg.ReservePush, Pop: cfg.ReservePop},
+		log:      logger.App,
 	}
 	go cp.connSupervisor()
-	return cp
+	return cp, nil
+}
+
+// MaxConn returns the pool capacity
+func (c *ConnPool) MaxConn() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.maxConn
+}
+
+// SetMaxConn changes the pool capacity, when it shrinks the connections over
+// the new capacity stay until they are done
+func (c *ConnPool) SetMaxConn(n int) {
+	c.mu.Lock()
+	c.maxConn = n
+	c.mu.Unlock()
+}
+
+// CloseAll closes every pooled connection and empties the pool, it returns
+// the number of closed connections
+func (c *ConnPool) CloseAll() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.list)
+	for _, cc := range c.list {
+		cc.Close()
+		c.tap.Publish(tap.Closed, cc.GetID(), "")
+	}
+	c.list = c.list[:0]
+	return n
+}
+
+// Len returns the number of pooled connections
+func (c *ConnPool) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.list)
 }
 
 // ConnPool represents a connection pool
@@ -25,80 +89,216 @@ type ConnPool struct {
 	connList *list.List
 	doneCh   <-chan interface{}
 	list     []*Conn
+	maxConn  int
+	quota    *Quota
+	eviction EvictionPolicy
+	reserve  Reserve
+	log      logger.Logger
+	tap      *tap.Hub
+	stats    PoolStats
+	// pendingPushes and pendingPops are admitted blocking requests which
+	// aren't blocked yet
+	pendingPushes int64
+	pendingPops   int64
 }
 
-func (c *ConnPool) isConnOutdated(cc *Conn) bool {
-	now := time.Now().Unix()
-	diff := (now - cc.time)
-	logger.App.Debugf("diff >= ConnExpiration diff %d now %d and conn time %d conn id %d", diff, now, cc.time, cc.GetID())
-	if diff >= ConnExpiration {
-		logger.App.Debugf("conn expired ", diff, now, cc.time, cc.GetID())
-		return true
+// PoolStats represents pool counters
+type PoolStats struct {
+	// Evictions are connections closed to make room for new ones
+	Evictions uint64
+	// Busy are connections turned away with the busy response as the pool
+	// is full
+	Busy uint64
+	// QuotaRejections are connections turned away with the busy response as
+	// the client is over its quota
+	QuotaRejections uint64
+	// ReserveRejections are blocking requests turned away with the busy
+	// response as the slots left are reserved for the opposite operation
+	ReserveRejections uint64
+}
+
+// Stats returns pool counters
+func (c *ConnPool) Stats() PoolStats {
+	return PoolStats{
+		Evictions:         atomic.LoadUint64(&c.stats.Evictions),
+		Busy:              atomic.LoadUint64(&c.stats.Busy),
+		QuotaRejections:   atomic.LoadUint64(&c.stats.QuotaRejections),
+		ReserveRejections: atomic.LoadUint64(&c.stats.ReserveRejections),
+	}
+}
+
+// ConnInfo represents a pooled connection as seen at the moment of a snapshot
+type ConnInfo struct {
+	ID     int
+	Remote string
+	State  State
+	Action string
+	// Age is how long the connection is in the pool, in whole seconds
+	Age       time.Duration
+	BytesRead int64
+}
+
+// Conns returns a snapshot of the pooled connections, the oldest first
+func (c *ConnPool) Conns() []ConnInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	conns := make([]ConnInfo, 0, len(c.list))
+	now := time.Now()
+	for _, cc := range c.list {
+		conns = append(conns, ConnInfo{
+			ID:        cc.GetID(),
+			Remote:    cc.Remote(),
+			State:     cc.GetState(),
+			Action:    cc.GetAction(),
+			Age:       cc.Age(now).Truncate(time.Second),
+			BytesRead: cc.BytesRead(),
+		})
+	}
+	return conns
+}
+
+// Kick closes the pooled connection with the given ID and frees it, it
+// returns false if there's no such connection
+func (c *ConnPool) Kick(id int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, cc := range c.list {
+		if cc.GetID() == id {
+			c.releaseConnByID(i)
+			// closed conn is inactive, so the queue skips it if it's blocked
+			cc.Close()
+			cc.Log().Infof("conn %d kicked", id)
+			return true
+		}
 	}
 	return false
 }
 
+// SetLogger sets the logger for lines not about a single connection
+func (c *ConnPool) SetLogger(l logger.Logger) {
+	c.mu.Lock()
+	c.log = l
+	c.mu.Unlock()
+}
+
+// SetTap sets the hub evictions, busy responses and closed connections are
+// published to, nil disables it
+func (c *ConnPool) SetTap(h *tap.Hub) {
+	c.mu.Lock()
+	c.tap = h
+	c.mu.Unlock()
+}
+
+// SetEvictionPolicy sets the policy used when the pool is full
+func (c *ConnPool) SetEvictionPolicy(p EvictionPolicy) {
+	c.mu.Lock()
+	c.eviction = p
+	c.mu.Unlock()
+}
+
+// SetQuota sets per-source limits, nil disables them
+func (c *ConnPool) SetQuota(q *Quota) {
+	c.mu.Lock()
+	c.quota = q
+	c.mu.Unlock()
+}
+
+// IPOccupancy returns the number of pooled connections per client IP
+func (c *ConnPool) IPOccupancy() map[string]int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	occupancy := make(map[string]int)
+	for _, cc := range c.list {
+		if ip := cc.RemoteIP(); ip != nil {
+			occupancy[ip.String()]++
+		}
+	}
+	return occupancy
+}
+
 // TryPush tries to push the conn
 func (c *ConnPool) TryPush(cc *Conn, readingQueue chan<- *Conn) {
-	connEv, ok := c.PushS(cc, readingQueue)
-	if ok && connEv != nil {
+	connEv, err := c.PushS(cc, readingQueue)
+	switch {
+	case err == ErrOverQuota:
+		atomic.AddUint64(&c.stats.QuotaRejections, 1)
+		c.tapHub().Publish(tap.Quota, cc.GetID(), cc.RemoteIP().String())
+		cc.Reject(formatter.RespBusy)
+	case err != nil:
+		//busy, nothing to evict
+		atomic.AddUint64(&c.stats.Busy, 1)
+		c.tapHub().Publish(tap.Busy, cc.GetID(), "pool is full")
+		cc.Log().Infof("pool busy %d", cc.GetID())
+		cc.Reject(formatter.RespBusy)
+	case connEv != nil:
 		// evicted connection, mark as inactive (to treat appropriately in waiting queues) and close
 		connEv.SetActive(false)
-		logger.App.Infof("conn evicted %d", cc.GetID())
+		atomic.AddUint64(&c.stats.Evictions, 1)
+		connEv.Log().Infof("conn evicted %d", connEv.GetID())
 		connEv.Close()
-	} else if !ok {
-		//busy, nothing to evict
-		logger.App.Infof("pool busy %d", cc.GetID())
-		cc.Write([]byte{0xFF}) // note#1 uncommented for test - test_server_resource_limit commented for test_pops_to_empty_stack
-		cc.Close()
 	}
 }
 
 // PushS pushes connection to the pool, if the pool size is exceeded, but no
-// connections that could be evicted - it returns false, if it has outdated connections,
-// it returns true (meaning that new connection has already been added to the pool) and
+// connections that could be evicted it returns ErrPoolFull and if the client
+// is over its quota ErrOverQuota. If it has outdated connections,
+// it returns nil error (meaning that new connection has already been added to the pool) and
 // the connection which should be then closed by caller
-func (c *ConnPool) PushS(cc *Conn, readingQueue chan<- *Conn) (*Conn, bool) {
+func (c *ConnPool) PushS(cc *Conn, readingQueue chan<- *Conn) (*Conn, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	ln := len(c.list)
-	logger.App.Debugf("connection pull length: %d", ln)
-	logger.App.Debugf("max conn : %d", MaxConn)
-	if ln < MaxConn {
-		cc.SetID(ln)
+	c.log.Debugf("connection pull length: %d", ln)
+	c.log.Debugf("max conn : %d", c.maxConn)
+	if c.quota != nil && !c.quota.allows(cc.RemoteIP(), c.remoteIPs()) {
+		cc.Log().Infof("client %s is over its pool quota", cc.RemoteIP())
+		return nil, ErrOverQuota
+	}
+	if ln < c.maxConn {
 		c.list = append(c.list, cc)
 		// callback call reading socket here
-		logger.App.Debugf("pushed conn ReadingQueue %d ", cc.GetID())
+		cc.Log().Debugf("pushed conn ReadingQueue %d ", cc.GetID())
+		cc.Trace().Start(trace.SpanReadingQueue)
 		select {
 		case readingQueue <- cc:
-			return nil, true
+			return nil, nil
 		}
 	}
-	first := c.list[0]
-	// evict outdated connection
-	if c.isConnOutdated(first) {
-		logger.App.Debug("note#1 conn outdated and will be evicted ")
-		c.list = c.list[1:]
+	// evict a connection chosen by the policy
+	if i, ok := c.eviction.Victim(c.list, time.Now()); ok {
+		victim := c.list[i]
+		victim.Log().Debugf("note#1 conn %d chosen by eviction policy and will be evicted", victim.GetID())
+		c.tap.Publish(tap.Evicted, victim.GetID(), "")
+		c.releaseConnByID(i)
 		c.list = append(c.list, cc)
+		cc.Trace().Start(trace.SpanReadingQueue)
 		readingQueue <- cc
-		return first, true
-	}
-	// evict inactive connection
-	// if commented, test_server_resource_limit works.
-	// if !first.CheckIsActive() {
-	// 	c.list = c.list[1:]
-	// 	c.list = append(c.list, cc)
-	// 	readingQueue <- cc
-	// 	return first, true
-	// }
-	logger.App.Debug("note#1 no more connections can be added to the pool, no evicted either 0xFF code")
+		return victim, nil
+	}
+	c.log.Debug("note#1 no more connections can be added to the pool, no evicted either 0xFF code")
 	// no more connections can be added to the pool, no evicted either
-	return nil, false
+	return nil, ErrPoolFull
+}
+
+// remoteIPs returns the client IPs of the pooled connections, the caller
+// holds the lock
+func (c *ConnPool) remoteIPs() []net.IP {
+	ips := make([]net.IP, 0, len(c.list))
+	for _, cc := range c.list {
+		ips = append(ips, cc.RemoteIP())
+	}
+	return ips
+}
+
+func (c *ConnPool) tapHub() *tap.Hub {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tap
 }
 
 func (c *ConnPool) checkIsActive(conn *Conn) bool {
 	if !conn.IsActive() {
-		logger.App.Debugf("conn %d is inactive", conn.GetID())
+		conn.Log().Debugf("conn %d is inactive", conn.GetID())
 		return false
 	}
 
@@ -110,13 +310,8 @@ func (c *ConnPool) connSupervisor() {
 		select {
 		case <-c.doneCh:
 			c.doneCh = nil
-			c.mu.Lock()
-			for _, cc := range c.list {
-				cc.Close()
-			}
-			c.list = c.list[:0]
-			c.mu.Unlock()
-			logger.App.Info("conn pool supervisor stopped")
+			c.CloseAll()
+			c.log.Info("conn pool supervisor stopped")
 			return
 		default:
 			time.Sleep(connCollectorInterval)
@@ -132,45 +327,33 @@ func (c *ConnPool) freeInactive() {
 		connInPool := c.list[i]
 		if !c.checkIsActive(connInPool) {
 			c.releaseConnByID(i)
+			i--
 			// avoiding double lock
 			connInPool.CloseL()
-			logger.App.Debugf("conn %d swept by the pool collector", connInPool.GetID())
+			connInPool.Log().Debugf("conn %d swept by the pool collector", connInPool.GetID())
 		}
 	}
 	c.mu.Unlock()
 }
 
+// releaseConnByID removes the i-th pool element keeping the order of the rest
 func (c *ConnPool) releaseConnByID(i int) {
-	// i is a single element
-	ln := len(c.list)
-	if ln == 1 {
-		c.list = c.list[:0]
-		return
-	}
+	c.tap.Publish(tap.Closed, c.list[i].GetID(), "")
 	// i is a first element
-	if i == 0 && ln > 1 {
-		c.list = c.list[i+1:]
-		return
-	}
-	// i is a last element
-	if i == (ln - 1) {
-		c.list = c.list[:i-1]
+	if i == 0 {
+		c.list = c.list[1:]
 		return
 	}
-	left := c.list[:i-1]
-	right := c.list[i+1:]
-	left = append(left, right...)
-	c.list = left
+	c.list = append(c.list[:i], c.list[i+1:]...)
 }
 
 // Free evicts given connection from the pool
 func (c *ConnPool) Free(conn *Conn) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	logger.App.Debugf("free conn id called %d", conn.GetID())
+	conn.Log().Debugf("free conn id called %d", conn.GetID())
 	for i, connInPool := range c.list {
-		if conn.GetID() == connInPool.GetID() {
-			// i is a single element
+		if conn == connInPool {
 			c.releaseConnByID(i)
 			return
 		}
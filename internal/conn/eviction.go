@@ -0,0 +1,117 @@
+package conn
+
+import (
+	"fmt"
+	"time"
+)
+
+// EvictionPolicy picks a pooled connection to make room for a new one when
+// the pool is full, pooled is ordered from the oldest to the newest
+type EvictionPolicy interface {
+	// Victim returns the index of the connection to evict, false means nothing
+	// may be evicted and the new connection gets the busy response
+	Victim(pooled []*Conn, now time.Time) (int, bool)
+}
+
+// NewEvictionPolicy returns a policy by its config name, maxAge is the time
+// a connection is safe from eviction
+func NewEvictionPolicy(name string, maxAge time.Duration) (EvictionPolicy, error) {
+	switch name {
+	case "oldest", "":
+		return OldestOverAge{MaxAge: maxAge}, nil
+	case "idle":
+		return LongestIdle{MaxIdle: maxAge}, nil
+	case "blocked":
+		return PreferBlocked{MaxAge: maxAge}, nil
+	case "reading":
+		return PreferReading{MaxAge: maxAge}, nil
+	case "never":
+		return NeverEvict{}, nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy %q, expected one of oldest, idle, blocked, reading, never", name)
+	}
+}
+
+// OldestOverAge evicts the oldest connection provided it's older than MaxAge
+type OldestOverAge struct {
+	MaxAge time.Duration
+}
+
+// Victim implements EvictionPolicy
+func (p OldestOverAge) Victim(pooled []*Conn, now time.Time) (int, bool) {
+	if len(pooled) == 0 {
+		return 0, false
+	}
+	first := pooled[0]
+	age := first.Age(now)
+	first.Log().Debugf("oldest conn %d age %s max age %s", first.GetID(), age, p.MaxAge)
+	return 0, age >= p.MaxAge
+}
+
+// LongestIdle evicts the connection nothing was read from for the longest
+// time, provided it's been idle for at least MaxIdle
+type LongestIdle struct {
+	MaxIdle time.Duration
+}
+
+// Victim implements EvictionPolicy
+func (p LongestIdle) Victim(pooled []*Conn, now time.Time) (int, bool) {
+	victim, maxIdle := -1, time.Duration(0)
+	for i, cc := range pooled {
+		if idle := cc.Idle(now); idle > maxIdle {
+			victim, maxIdle = i, idle
+		}
+	}
+	if victim < 0 || maxIdle < p.MaxIdle {
+		return 0, false
+	}
+	return victim, true
+}
+
+// PreferBlocked evicts the oldest connection blocked on a full or an empty
+// stack, falling back to OldestOverAge when none of them is old enough
+type PreferBlocked struct {
+	MaxAge time.Duration
+}
+
+// Victim implements EvictionPolicy
+func (p PreferBlocked) Victim(pooled []*Conn, now time.Time) (int, bool) {
+	if i, ok := oldestInState(pooled, now, p.MaxAge, StateBlockedPush, StateBlockedPop); ok {
+		return i, true
+	}
+	return OldestOverAge{MaxAge: p.MaxAge}.Victim(pooled, now)
+}
+
+// PreferReading evicts the oldest connection which is still sending its
+// request, falling back to OldestOverAge when none of them is old enough
+type PreferReading struct {
+	MaxAge time.Duration
+}
+
+// Victim implements EvictionPolicy
+func (p PreferReading) Victim(pooled []*Conn, now time.Time) (int, bool) {
+	if i, ok := oldestInState(pooled, now, p.MaxAge, StateReadingHeader, StateReadingBody); ok {
+		return i, true
+	}
+	return OldestOverAge{MaxAge: p.MaxAge}.Victim(pooled, now)
+}
+
+// NeverEvict never evicts, a full pool always answers busy
+type NeverEvict struct{}
+
+// Victim implements EvictionPolicy
+func (NeverEvict) Victim([]*Conn, time.Time) (int, bool) {
+	return 0, false
+}
+
+func oldestInState(pooled []*Conn, now time.Time, maxAge time.Duration, states ...State) (int, bool) {
+	for i, cc := range pooled {
+		st := cc.GetState()
+		for _, s := range states {
+			if st == s && cc.Age(now) >= maxAge {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
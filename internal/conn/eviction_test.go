@@ -0,0 +1,118 @@
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func testConn(id int, now time.Time, age, idle time.Duration, state State) *Conn {
+	c := &Conn{}
+	c.SetID(id)
+	c.SetTime(now.Add(-age).Unix())
+	c.lastRead = now.Add(-idle).UnixNano()
+	c.setState(state)
+	return c
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	now := time.Unix(100000, 0)
+	maxAge := 10 * time.Second
+	tests := []struct {
+		name   string
+		policy string
+		pooled []*Conn
+		victim int
+		ok     bool
+	}{
+		{
+			name:   "oldest over age",
+			policy: "oldest",
+			pooled: []*Conn{
+				testConn(0, now, 11*time.Second, time.Second, StateBlockedPop),
+				testConn(1, now, 20*time.Second, 20*time.Second, StateBlockedPop),
+			},
+			victim: 0,
+			ok:     true,
+		},
+		{
+			name:   "oldest too young",
+			policy: "oldest",
+			pooled: []*Conn{
+				testConn(0, now, 5*time.Second, 5*time.Second, StateBlockedPop),
+			},
+			ok: false,
+		},
+		{
+			name:   "longest idle",
+			policy: "idle",
+			pooled: []*Conn{
+				testConn(0, now, 30*time.Second, time.Second, StateReadingBody),
+				testConn(1, now, 25*time.Second, 15*time.Second, StateReadingBody),
+				testConn(2, now, 20*time.Second, 12*time.Second, StateReadingBody),
+			},
+			victim: 1,
+			ok:     true,
+		},
+		{
+			name:   "nobody idle long enough",
+			policy: "idle",
+			pooled: []*Conn{
+				testConn(0, now, 30*time.Second, 9*time.Second, StateReadingBody),
+			},
+			ok: false,
+		},
+		{
+			name:   "prefer blocked waiter",
+			policy: "blocked",
+			pooled: []*Conn{
+				testConn(0, now, 30*time.Second, 30*time.Second, StateReadingBody),
+				testConn(1, now, 20*time.Second, 20*time.Second, StateBlockedPush),
+			},
+			victim: 1,
+			ok:     true,
+		},
+		{
+			name:   "blocked falls back to oldest",
+			policy: "blocked",
+			pooled: []*Conn{
+				testConn(0, now, 30*time.Second, 30*time.Second, StateReadingBody),
+				testConn(1, now, 5*time.Second, 5*time.Second, StateBlockedPop),
+			},
+			victim: 0,
+			ok:     true,
+		},
+		{
+			name:   "prefer still reading",
+			policy: "reading",
+			pooled: []*Conn{
+				testConn(0, now, 30*time.Second, 30*time.Second, StateBlockedPop),
+				testConn(1, now, 20*time.Second, 1*time.Second, StateReadingHeader),
+			},
+			victim: 1,
+			ok:     true,
+		},
+		{
+			name:   "never evict",
+			policy: "never",
+			pooled: []*Conn{
+				testConn(0, now, time.Hour, time.Hour, StateBlockedPop),
+			},
+			ok: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewEvictionPolicy(tt.policy, maxAge)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			victim, ok := p.Victim(tt.pooled, now)
+			if ok != tt.ok || (ok && victim != tt.victim) {
+				t.Fatalf("Victim() = %d %v, expected %d %v", victim, ok, tt.victim, tt.ok)
+			}
+		})
+	}
+	if _, err := NewEvictionPolicy("random", maxAge); err == nil {
+		t.Fatalf("expected unknown policy error")
+	}
+}
@@ -0,0 +1,79 @@
+package conn
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// CIDRLimit limits concurrent pool slots taken by all clients of a network
+type CIDRLimit struct {
+	Net   *net.IPNet
+	Limit int
+}
+
+// Quota represents per-source limits on concurrent pool slots, zero values
+// mean no limit. When networks overlap only the most specific one containing
+// the client applies
+type Quota struct {
+	PerIP int
+	// CIDRs are ordered from the most specific network to the least one
+	CIDRs []CIDRLimit
+}
+
+// NewQuota builds a quota from per IP limit and limits keyed by network in
+// CIDR notation
+func NewQuota(perIP int, cidrs map[string]int) (*Quota, error) {
+	q := &Quota{PerIP: perIP}
+	for cidr, limit := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("malformed cidr limit %q: %v", cidr, err)
+		}
+		if limit < 1 {
+			return nil, fmt.Errorf("cidr limit for %s must be positive", cidr)
+		}
+		q.CIDRs = append(q.CIDRs, CIDRLimit{Net: ipNet, Limit: limit})
+	}
+	sort.Slice(q.CIDRs, func(i, j int) bool {
+		iOnes, _ := q.CIDRs[i].Net.Mask.Size()
+		jOnes, _ := q.CIDRs[j].Net.Mask.Size()
+		if iOnes != jOnes {
+			return iOnes > jOnes
+		}
+		return q.CIDRs[i].Net.String() < q.CIDRs[j].Net.String()
+	})
+	return q, nil
+}
+
+// allows checks whether one more connection from ip fits into the quota given
+// the client IPs of the connections already in the pool
+func (q *Quota) allows(ip net.IP, pooled []net.IP) bool {
+	if ip == nil {
+		return true
+	}
+	if q.PerIP > 0 {
+		n := 0
+		for _, other := range pooled {
+			if ip.Equal(other) {
+				n++
+			}
+		}
+		if n >= q.PerIP {
+			return false
+		}
+	}
+	for _, l := range q.CIDRs {
+		if !l.Net.Contains(ip) {
+			continue
+		}
+		n := 0
+		for _, other := range pooled {
+			if other != nil && l.Net.Contains(other) {
+				n++
+			}
+		}
+		return n < l.Limit
+	}
+	return true
+}
@@ -0,0 +1,142 @@
+package conn
+
+import (
+	"net"
+	"testing"
+)
+
+func ips(addrs ...string) []net.IP {
+	list := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		list = append(list, net.ParseIP(a))
+	}
+	return list
+}
+
+func TestQuota_allows(t *testing.T) {
+	tests := []struct {
+		name   string
+		perIP  int
+		cidrs  map[string]int
+		ip     net.IP
+		pooled []net.IP
+		want   bool
+	}{
+		{
+			name:   "per ip under limit",
+			perIP:  2,
+			ip:     net.ParseIP("10.0.0.1"),
+			pooled: ips("10.0.0.1", "10.0.0.2"),
+			want:   true,
+		},
+		{
+			name:   "per ip at limit",
+			perIP:  2,
+			ip:     net.ParseIP("10.0.0.1"),
+			pooled: ips("10.0.0.1", "10.0.0.2", "10.0.0.1"),
+			want:   false,
+		},
+		{
+			name:   "cidr at limit",
+			cidrs:  map[string]int{"10.0.0.0/8": 2},
+			ip:     net.ParseIP("10.0.0.3"),
+			pooled: ips("10.0.0.1", "10.1.0.2", "192.168.0.1"),
+			want:   false,
+		},
+		{
+			name:   "client outside every cidr",
+			cidrs:  map[string]int{"10.0.0.0/8": 1},
+			ip:     net.ParseIP("192.168.0.1"),
+			pooled: ips("10.0.0.1", "192.168.0.2"),
+			want:   true,
+		},
+		{
+			name:   "more specific cidr raises the limit",
+			cidrs:  map[string]int{"10.0.0.0/8": 1, "10.1.0.0/16": 3},
+			ip:     net.ParseIP("10.1.0.3"),
+			pooled: ips("10.1.0.1", "10.1.0.2"),
+			want:   true,
+		},
+		{
+			name:   "more specific cidr lowers the limit",
+			cidrs:  map[string]int{"10.0.0.0/8": 10, "10.1.0.0/16": 1},
+			ip:     net.ParseIP("10.1.0.3"),
+			pooled: ips("10.1.0.1"),
+			want:   false,
+		},
+		{
+			name:   "broader cidr applies outside the specific one",
+			cidrs:  map[string]int{"10.0.0.0/8": 2, "10.1.0.0/16": 10},
+			ip:     net.ParseIP("10.2.0.1"),
+			pooled: ips("10.1.0.1", "10.2.0.2"),
+			want:   false,
+		},
+		{
+			name:   "ipv6 per ip",
+			perIP:  1,
+			ip:     net.ParseIP("2001:db8::1"),
+			pooled: ips("2001:db8::1"),
+			want:   false,
+		},
+		{
+			name:   "ipv6 cidr",
+			cidrs:  map[string]int{"2001:db8::/32": 2, "10.0.0.0/8": 1},
+			ip:     net.ParseIP("2001:db8:1::1"),
+			pooled: ips("2001:db8::1", "10.0.0.1"),
+			want:   true,
+		},
+		{
+			name:   "ipv4 cidr ignores ipv6 clients",
+			cidrs:  map[string]int{"0.0.0.0/0": 1},
+			ip:     net.ParseIP("2001:db8::1"),
+			pooled: ips("10.0.0.1"),
+			want:   true,
+		},
+		{
+			name:   "unknown client ip",
+			perIP:  1,
+			cidrs:  map[string]int{"0.0.0.0/0": 1},
+			ip:     nil,
+			pooled: []net.IP{nil, net.ParseIP("10.0.0.1")},
+			want:   true,
+		},
+		{
+			name:   "unknown pooled ips are not counted",
+			perIP:  1,
+			cidrs:  map[string]int{"0.0.0.0/0": 1},
+			ip:     net.ParseIP("10.0.0.1"),
+			pooled: []net.IP{nil, nil},
+			want:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := NewQuota(tt.perIP, tt.cidrs)
+			if err != nil {
+				t.Fatalf("NewQuota() error = %v", err)
+			}
+			if got := q.allows(tt.ip, tt.pooled); got != tt.want {
+				t.Errorf("allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewQuota(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidrs   map[string]int
+		wantErr bool
+	}{
+		{"valid", map[string]int{"10.0.0.0/8": 1, "::/0": 2}, false},
+		{"malformed cidr", map[string]int{"10.0.0.0": 1}, true},
+		{"zero limit", map[string]int{"10.0.0.0/8": 0}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewQuota(0, tt.cidrs); (err != nil) != tt.wantErr {
+				t.Errorf("NewQuota() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
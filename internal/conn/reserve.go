@@ -0,0 +1,59 @@
+package conn
+
+import (
+	"sync/atomic"
+
+	"github.com/sKudryashov/stacksrv/internal/service/formatter"
+	"github.com/sKudryashov/stacksrv/internal/tap"
+)
+
+// Reserve represents pool slots kept for one operation while the opposite
+// one is blocked, e.g. with Push=5 blocked pops can never take more than
+// pool size - 5 slots, so a push can always get in and unblock them
+type Reserve struct {
+	Push int
+	Pop  int
+}
+
+// SetReserve sets reserved capacity classes, zero Reserve disables them
+func (c *ConnPool) SetReserve(r Reserve) {
+	c.mu.Lock()
+	c.reserve = r
+	c.mu.Unlock()
+}
+
+// Admit decides right after the request header is parsed whether the
+// connection may stay in the pool. wouldBlock tells that the request can't
+// be served right away (pop on an empty stack, push on a full one), only such
+// requests are limited. Admitted blocking requests are counted as pending
+// until they get blocked or closed, so concurrent admissions count them while
+// their state still tells what they actually do
+func (c *ConnPool) Admit(cc *Conn, wouldBlock bool) bool {
+	if !wouldBlock {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state, reserved, pending := StateBlockedPop, c.reserve.Push, &c.pendingPops
+	if cc.GetAction() == formatter.ActionPush {
+		state, reserved, pending = StateBlockedPush, c.reserve.Pop, &c.pendingPushes
+	}
+	if reserved > 0 {
+		blocked := int(atomic.LoadInt64(pending))
+		for _, pooled := range c.list {
+			if pooled != cc && pooled.GetState() == state {
+				blocked++
+			}
+		}
+		if blocked >= c.maxConn-reserved {
+			atomic.AddUint64(&c.stats.ReserveRejections, 1)
+			c.tap.Publish(tap.Busy, cc.GetID(), "slots are reserved")
+			return false
+		}
+	}
+	atomic.AddInt64(pending, 1)
+	// the counter is released without the pool lock, connections are closed
+	// while it's held
+	cc.setAdmission(func() { atomic.AddInt64(pending, -1) })
+	return true
+}
@@ -0,0 +1,57 @@
+package conn
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/sKudryashov/stacksrv/internal/service/formatter"
+)
+
+func TestConnPool_Admit(t *testing.T) {
+	pool := &ConnPool{maxConn: 100, reserve: Reserve{Push: 2}}
+	for i := 0; i < pool.maxConn-2; i++ {
+		cc := &Conn{}
+		cc.SetAction(formatter.ActionPop)
+		pool.list = append(pool.list, cc)
+		if !pool.Admit(cc, true) {
+			t.Fatalf("pop %d rejected before reserved slots are reached", i)
+		}
+	}
+	pop := &Conn{}
+	pop.SetAction(formatter.ActionPop)
+	pool.list = append(pool.list, pop)
+	if pool.Admit(pop, true) {
+		t.Fatalf("blocking pop took a slot reserved for pushes")
+	}
+	if st := pool.Stats(); st.ReserveRejections != 1 || st.Busy != 0 {
+		t.Errorf("Stats() = %+v, want a reserve rejection and no busy", st)
+	}
+	if !pool.Admit(pop, false) {
+		t.Fatalf("pop that doesn't block is rejected")
+	}
+	push := &Conn{}
+	push.SetAction(formatter.ActionPush)
+	pool.list = append(pool.list, push)
+	if !pool.Admit(push, true) {
+		t.Fatalf("push rejected though pops reserve nothing")
+	}
+	if s := push.GetState(); s != StateReadingHeader {
+		t.Errorf("admitted push state = %s, want it left alone", s)
+	}
+
+	// blocked or closed, a pop no longer holds its admission, blocked pops
+	// are counted by their state
+	pool.list[0].MarkBlocked()
+	pool.list[0].MarkBlocked()
+	if pool.Admit(pop, true) {
+		t.Fatalf("blocked pop released a reserved slot")
+	}
+	pool.list[1].releaseAdmission()
+	pool.list = pool.list[2:]
+	if !pool.Admit(pop, true) {
+		t.Fatalf("closed pop still holds its admission")
+	}
+	if n := atomic.LoadInt64(&pool.pendingPops); n != int64(pool.maxConn-2-1) {
+		t.Errorf("pending pops = %d, want %d", n, pool.maxConn-2-1)
+	}
+}
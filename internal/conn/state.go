@@ -0,0 +1,34 @@
+package conn
+
+// State represents the stage of request handling a connection is at
+type State int
+
+const (
+	// StateReadingHeader the request header byte hasn't arrived yet
+	StateReadingHeader State = iota
+	// StateReadingBody the header is parsed, payload is being read
+	StateReadingBody
+	// StateBlockedPush the push waits for room in a full stack
+	StateBlockedPush
+	// StateBlockedPop the pop waits for an item in an empty stack
+	StateBlockedPop
+	// StateWriting the response is being written
+	StateWriting
+)
+
+func (s State) String() string {
+	switch s {
+	case StateReadingHeader:
+		return "reading-header"
+	case StateReadingBody:
+		return "reading-body"
+	case StateBlockedPush:
+		return "blocked-push"
+	case StateBlockedPop:
+		return "blocked-pop"
+	case StateWriting:
+		return "writing"
+	default:
+		return "unknown"
+	}
+}
@@ -6,28 +6,164 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
+	"github.com/sKudryashov/stacksrv/internal/auth"
 	"github.com/sKudryashov/stacksrv/internal/conn"
+	"github.com/sKudryashov/stacksrv/internal/ratelimit"
 	"github.com/sKudryashov/stacksrv/internal/service"
 	"github.com/sKudryashov/stacksrv/internal/service/formatter"
+	"github.com/sKudryashov/stacksrv/internal/tap"
+	"github.com/sKudryashov/stacksrv/internal/trace"
+	"github.com/sKudryashov/stacksrv/pkg/config"
 	"github.com/sKudryashov/stacksrv/pkg/logger"
 )
 
+const (
+	tlsHandshakeTimeout = time.Second * 5
+	// bodyReadGrace is added to the body deadline derived from the minimum rate
+	bodyReadGrace = time.Second
+)
+
+// Stats represents counters of connections closed by the reader
+type Stats struct {
+	// SlowHeaders didn't send the header within the header timeout, or the
+	// whole request when there's no minimum rate
+	SlowHeaders uint64
+	// SlowBodies sent the payload slower than the minimum rate
+	SlowBodies uint64
+	// EOFs closed the connection before the request was complete
+	EOFs uint64
+}
+
 // TCP represents TCP connection handler
 type TCP struct {
-	pool  *conn.ConnPool
-	queue *service.Queue
+	pool      *conn.ConnPool
+	queue     *service.Queue
+	tokens    *auth.Tokens
+	limiter   *ratelimit.Limiter
+	limitCode byte
+	// headerTimeout and minRate (bytes per second) define a slow client, 0 rate
+	// means only the header deadline applies to the whole request
+	headerTimeout time.Duration
+	minRate       float64
+	stats         Stats
+	onHandled     HandledFunc
+	log           logger.Logger
+	tap           *tap.Hub
 }
 
-// NewTCP constructor
-func NewTCP(pool *conn.ConnPool) *TCP {
+// HandledFunc is called once a request is processed, answered is false when
+// it's blocked or its connection is gone
+type HandledFunc func(action string, answered bool, elapsed time.Duration, err error)
+
+// NewTCP constructor, the queue workers run until doneCh is closed
+func NewTCP(doneCh <-chan interface{}, pool *conn.ConnPool, cfg *config.Config) *TCP {
 	return &TCP{
-		pool:  pool,
-		queue: service.NewQService(),
+		pool:          pool,
+		queue:         service.NewQService(doneCh, cfg.Stack),
+		headerTimeout: cfg.Reader.HeaderTimeout.Duration,
+		minRate:       cfg.Reader.MinRate,
+		log:           logger.App,
+	}
+}
+
+// Stats returns reader counters
+func (t *TCP) Stats() Stats {
+	return Stats{
+		SlowHeaders: atomic.LoadUint64(&t.stats.SlowHeaders),
+		SlowBodies:  atomic.LoadUint64(&t.stats.SlowBodies),
+		EOFs:        atomic.LoadUint64(&t.stats.EOFs),
+	}
+}
+
+// Queue returns the queue service requests are handled by
+func (t *TCP) Queue() *service.Queue {
+	return t.queue
+}
+
+// DrainWaiters answers blocked requests with shutting down and frees them
+// from the pool, it returns the number of drained requests
+func (t *TCP) DrainWaiters() int {
+	drained := t.queue.DrainWaiters()
+	t.free(drained)
+	return len(drained)
+}
+
+// BounceWaiters answers blocked requests with busy and frees them from the
+// pool, it returns the number of bounced requests
+func (t *TCP) BounceWaiters() int {
+	bounced := t.queue.BounceWaiters()
+	t.free(bounced)
+	return len(bounced)
+}
+
+// ClearWaiters disconnects blocked requests and frees them from the pool, it
+// returns the number of disconnected requests
+func (t *TCP) ClearWaiters() int {
+	cleared := t.queue.ClearWaiters()
+	t.free(cleared)
+	return len(cleared)
+}
+
+// Reset clears the stack and waiters and closes every pooled connection in
+// one go, the listener keeps accepting. It returns the number of dropped
+// items and closed connections
+func (t *TCP) Reset() (int, int) {
+	closed := 0
+	items, cleared := t.queue.Reset(func(cleared []service.WriterAPI) {
+		t.free(cleared)
+		closed = t.pool.CloseAll()
+	})
+	return items, len(cleared) + closed
+}
+
+func (t *TCP) free(released []service.WriterAPI) {
+	for _, w := range released {
+		if cc, ok := w.(*conn.Conn); ok {
+			t.pool.Free(cc)
+		}
 	}
 }
 
+// SetPolicy sets identity permissions policy enforced by the queue
+func (t *TCP) SetPolicy(p *auth.Policy) {
+	t.queue.SetPolicy(p)
+}
+
+// SetTokens enables token authentication, every connection has to start with
+// an auth frame: one byte of token length followed by the token itself
+func (t *TCP) SetTokens(tokens *auth.Tokens) {
+	t.tokens = tokens
+}
+
+// SetRateLimit enables per identity rate limiting, throttled requests are
+// answered with code
+func (t *TCP) SetRateLimit(l *ratelimit.Limiter, code byte) {
+	t.limiter = l
+	t.limitCode = code
+}
+
+// SetLogger sets the logger for lines not about a single connection, it's not
+// safe to call once the handler is in use
+func (t *TCP) SetLogger(l logger.Logger) {
+	t.log = l
+	t.queue.SetLogger(l)
+}
+
+// SetTap sets the hub parsed headers and queue events are published to, nil
+// disables it. It's not safe to call once the handler is in use
+func (t *TCP) SetTap(h *tap.Hub) {
+	t.tap = h
+	t.queue.SetTap(h)
+}
+
+// SetHandledHook sets a function called for every processed request
+func (t *TCP) SetHandledHook(f HandledFunc) {
+	t.onHandled = f
+}
+
 // ConnListener listens an ordered conn queue, discards slow or err connections
 // and proceeds with normal ones
 func (t *TCP) ConnListener(readingQueue <-chan *conn.Conn, stopCh <-chan interface{}) {
@@ -37,16 +173,18 @@ func (t *TCP) ConnListener(readingQueue <-chan *conn.Conn, stopCh <-chan interfa
 	for {
 		select {
 		case <-stopCh:
-			logger.App.Info("server stop signal received, closing conn listener")
+			t.log.Info("server stop signal received, closing conn listener")
 			close(bodyReaderStop)
 			connReady = nil
 			readErr = nil
 			return
 		case cc := <-readErr:
-			logger.App.Errorf("conn listener got an error %s", cc.GetErr())
+			cc.Log().Errorf("conn listener got an error %s", cc.GetErr())
 			cc.WriteErr()
 			t.pool.Free(cc)
 		case cc := <-readingQueue:
+			cc.Trace().End(trace.SpanReadingQueue)
+			cc.Trace().Start(trace.SpanOrdering)
 			// slow down goroutines to guarantee order of execution, since bu default go routines order is not guaranteed.
 			time.Sleep(time.Millisecond * 20)
 			go t.readBody(cc, connReady, readErr, bodyReaderStop)
@@ -58,9 +196,40 @@ func (t *TCP) readBody(conn *conn.Conn, connReady chan *conn.Conn, cherr chan *c
 	bytesBuf := make([]byte, 0, 128)
 	bufReader := bufio.NewReader(conn)
 	var contentLn int64
+	var bodyStart time.Time
+	// rateDeadline tells the read deadline comes from the minimum rate, not
+	// from the header timeout
+	rateDeadline := false
 	i := 0
-	conn.SetReadDeadline(time.Now().Add(time.Second * 20))
+	tr := conn.Trace()
+	tr.End(trace.SpanOrdering)
+	tr.Start(trace.SpanReadBody)
+	// handshake has its own timeout, the read deadline starts counting after it
+	if err := conn.Handshake(tlsHandshakeTimeout); err != nil {
+		conn.Log().Errorf("tls handshake failed %d %v", conn.GetID(), err)
+		conn.SetErr(err)
+		cherr <- conn
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(t.headerTimeout))
 	conn.SetKeepAlive(true)
+	if t.tokens != nil {
+		if err := t.authenticate(conn, bufReader); err != nil {
+			conn.Log().Errorf("conn %d authentication failed %v", conn.GetID(), err)
+			conn.WriteUnauthenticated()
+			conn.SetErr(err)
+			cherr <- conn
+			return
+		}
+	}
+	// source IP is limited on accept, here it's the identity turn once it's known
+	if id := conn.GetIdentity(); t.limiter != nil && id != "" && !t.limiter.Allow("id:"+id) {
+		conn.Log().Infof("conn %d identity %q is throttled", conn.GetID(), id)
+		conn.WriteThrottled(t.limitCode)
+		conn.SetErr(fmt.Errorf("identity %q is throttled", id))
+		cherr <- conn
+		return
+	}
 
 	for {
 		select {
@@ -68,12 +237,15 @@ func (t *TCP) readBody(conn *conn.Conn, connReady chan *conn.Conn, cherr chan *c
 			conn.Close()
 			cherr = nil
 			connReady = nil
-			logger.App.Info("body reader closed")
+			conn.Log().Info("body reader closed")
 			return
 		default:
 		}
 		bb, err := bufReader.ReadByte()
-		if i == 0 {
+		if err == nil {
+			conn.CountRead(1)
+		}
+		if i == 0 && err == nil {
 			action, payloadSize, err := formatter.ParseRequest(bb)
 			if err != nil {
 				conn.SetErr(err)
@@ -81,25 +253,54 @@ func (t *TCP) readBody(conn *conn.Conn, connReady chan *conn.Conn, cherr chan *c
 				break
 			}
 			conn.SetAction(action)
+			conn.MarkReadingBody()
+			t.tap.Publishf(tap.Header, conn.GetID(), "%s len=%d", formatter.ActionName(action), payloadSize)
+			tr.SetAttr("action", formatter.ActionName(action))
+			tr.SetAttr("payload_len", int(payloadSize))
 			contentLn = payloadSize
+			if !t.pool.Admit(conn, t.queue.WouldBlock(action)) {
+				conn.Log().Infof("conn %d would take a slot reserved for the opposite operation", conn.GetID())
+				conn.WriteBusyState()
+				conn.SetErr(fmt.Errorf("no unreserved slots left for action %s", action))
+				cherr <- conn
+				return
+			}
 		}
 		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				switch {
+				case rateDeadline:
+					atomic.AddUint64(&t.stats.SlowBodies, 1)
+					conn.Log().Infof("conn %d sent %d of %d bytes, slower than %.1f bytes/s, closing", conn.GetID(), i-1, contentLn, t.minRate)
+				case i == 0:
+					atomic.AddUint64(&t.stats.SlowHeaders, 1)
+					conn.Log().Infof("conn %d didn't send the header in %s, closing", conn.GetID(), t.headerTimeout)
+				default:
+					// without the minimum rate the header deadline covers the whole request
+					atomic.AddUint64(&t.stats.SlowHeaders, 1)
+					conn.Log().Infof("conn %d sent %d of %d bytes in %s, closing", conn.GetID(), i-1, contentLn, t.headerTimeout)
+				}
+				conn.SetErr(err)
+				cherr <- conn
+				return
+			}
 			switch err := err.(type) {
 			case *net.OpError:
-				logger.App.Errorf("tcp.go conn error %v %s", err, string(conn.GetData()))
+				conn.Log().Errorf("tcp.go conn error %v %s", err, string(conn.GetData()))
 				bufReader.UnreadByte()
 				conn.SetErr(err)
 				cherr <- conn
 				return
 			default:
 				if err == io.EOF {
-					logger.App.Errorf("io.EOF Error: %v", err)
+					atomic.AddUint64(&t.stats.EOFs, 1)
+					conn.Log().Errorf("io.EOF Error: %v", err)
 					bufReader.UnreadByte()
 					conn.SetErr(err)
 					cherr <- conn
 					return
 				}
-				logger.App.Errorf("io.EOF Error %v", err)
+				conn.Log().Errorf("io.EOF Error %v", err)
 				bufReader.UnreadByte()
 				conn.SetErr(err)
 				cherr <- conn
@@ -108,9 +309,17 @@ func (t *TCP) readBody(conn *conn.Conn, connReady chan *conn.Conn, cherr chan *c
 		}
 		bytesBuf = append(bytesBuf, bb)
 		i++
+		// every next payload byte has to keep the average rate above the minimum
+		if t.minRate > 0 {
+			if i == 1 {
+				bodyStart = time.Now()
+			}
+			conn.SetReadDeadline(bodyStart.Add(bodyReadGrace + time.Duration(float64(i)/t.minRate*float64(time.Second))))
+			rateDeadline = true
+		}
 		if int64(i) == contentLn+1 {
-			logger.App.Debugf("content ln %d  actual message size %d", contentLn, len(bytesBuf))
-			logger.App.Debugf("socket data read %s", string(conn.GetAction()))
+			conn.Log().Debugf("content ln %d  actual message size %d", contentLn, len(bytesBuf))
+			conn.Log().Debugf("socket data read %s", string(conn.GetAction()))
 			break
 		}
 	}
@@ -129,16 +338,45 @@ func (t *TCP) readBody(conn *conn.Conn, connReady chan *conn.Conn, cherr chan *c
 	if !conn.IsActive() {
 		return
 	}
+	tr.End(trace.SpanReadBody)
 	// a rule of thumb
 	conn.Ctx = context.TODO()
 	t.HandleConn(conn.Ctx, conn)
 }
 
+// authenticate reads the auth frame and binds the token identity to the conn
+// unless TLS already gave it one
+func (t *TCP) authenticate(conn *conn.Conn, r *bufio.Reader) error {
+	ln, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("unable to read auth frame: %v", err)
+	}
+	if ln == 0 || ln > auth.MaxTokenLen {
+		return fmt.Errorf("malformed auth frame header %#x", ln)
+	}
+	token := make([]byte, ln)
+	if _, err := io.ReadFull(r, token); err != nil {
+		return fmt.Errorf("unable to read auth token: %v", err)
+	}
+	identity, ok := t.tokens.Validate(token)
+	if !ok {
+		return fmt.Errorf("invalid token")
+	}
+	if conn.GetIdentity() == "" {
+		conn.SetIdentity(identity)
+	}
+	return nil
+}
+
 // HandleConn reads tcp connection, faster clients go first exactly here
 func (t *TCP) HandleConn(ctx context.Context, conn *conn.Conn) {
+	start := time.Now()
 	releaseConn, err := t.queue.ProcessRequest(ctx, conn)
+	if t.onHandled != nil {
+		t.onHandled(conn.GetAction(), releaseConn, time.Since(start), err)
+	}
 	if err != nil {
-		logger.App.Errorf("error processing request %d %v", conn.GetID(), err)
+		conn.Log().Errorf("error processing request %d %v", conn.GetID(), err)
 		t.pool.Free(conn)
 		return
 	}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sKudryashov/stacksrv/internal/conn"
+	"github.com/sKudryashov/stacksrv/pkg/config"
+)
+
+func TestTCP_readBodyTimeouts(t *testing.T) {
+	tests := []struct {
+		name      string
+		minRate   float64
+		sent      []byte
+		wantStats Stats
+	}{
+		{"no header", 0, nil, Stats{SlowHeaders: 1}},
+		{"no min rate, partial payload", 0, []byte("\x03a"), Stats{SlowHeaders: 1}},
+		{"min rate, no header", 1000, nil, Stats{SlowHeaders: 1}},
+		{"min rate, partial payload", 1000, []byte("\x03a"), Stats{SlowBodies: 1}},
+	}
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen error = %v", err)
+	}
+	defer ln.Close()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Defaults()
+			cfg.Reader.HeaderTimeout.Duration = 100 * time.Millisecond
+			cfg.Reader.MinRate = tt.minRate
+			done := make(chan interface{})
+			defer close(done)
+			pool, err := conn.NewConnPool(done, cfg.Pool)
+			if err != nil {
+				t.Fatalf("NewConnPool() error = %v", err)
+			}
+			h := NewTCP(done, pool, cfg)
+
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("dial error = %v", err)
+			}
+			defer client.Close()
+			tcpConn, err := ln.AcceptTCP()
+			if err != nil {
+				t.Fatalf("accept error = %v", err)
+			}
+			cc := &conn.Conn{TCPConn: tcpConn}
+			cc.SetActive(true)
+			defer cc.Close()
+			if _, err := client.Write(tt.sent); err != nil {
+				t.Fatalf("write error = %v", err)
+			}
+
+			failed := make(chan *conn.Conn, 1)
+			go h.readBody(cc, make(chan *conn.Conn, 1), failed, done)
+			select {
+			case <-failed:
+			case <-time.After(3 * time.Second):
+				t.Fatalf("slow client isn't closed")
+			}
+			if got := h.Stats(); got != tt.wantStats {
+				t.Errorf("Stats() = %+v, want %+v", got, tt.wantStats)
+			}
+		})
+	}
+}
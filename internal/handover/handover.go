@@ -0,0 +1,262 @@
+package handover
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/sKudryashov/stacksrv/internal/sockets"
+)
+
+// envHandover tells a new process it's started by an old one which passes
+// its listeners and stack over, its value is the listener names in the order
+// of their descriptors
+const envHandover = "SERVD_HANDOVER"
+
+// inherited descriptors, ExtraFiles start at 3 and listeners follow the pipes
+const (
+	fdState = 3 + iota
+	fdReady
+	fdListeners
+)
+
+// Listener names, the order listeners are passed in
+const (
+	NameService = "service"
+	NameControl = "control"
+	NameAdmin   = "admin"
+	NameMetrics = "metrics"
+	NamePprof   = "pprof"
+)
+
+// state is what the old process sends once it's drained
+type state struct {
+	Items [][]byte `json:"items"`
+}
+
+// Listeners represents the listeners passed over, nil ones aren't
+type Listeners struct {
+	Service *net.TCPListener
+	Control *net.TCPListener
+	Admin   *net.TCPListener
+	Metrics *net.TCPListener
+	Pprof   *net.TCPListener
+}
+
+// byName returns pointers to the listeners in the order they are passed in
+func (l *Listeners) byName() []struct {
+	name string
+	ln   **net.TCPListener
+} {
+	return []struct {
+		name string
+		ln   **net.TCPListener
+	}{
+		{NameService, &l.Service},
+		{NameControl, &l.Control},
+		{NameAdmin, &l.Admin},
+		{NameMetrics, &l.Metrics},
+		{NamePprof, &l.Pprof},
+	}
+}
+
+// set sets the listener named name, false means there's no such name
+func (l *Listeners) set(name string, ln *net.TCPListener) bool {
+	for _, named := range l.byName() {
+		if named.name == name {
+			*named.ln = ln
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes every listener
+func (l *Listeners) Close() {
+	for _, named := range l.byName() {
+		if *named.ln != nil {
+			(*named.ln).Close()
+		}
+	}
+}
+
+// Inherited represents what a new process gets from the old one
+type Inherited struct {
+	Listeners
+	state *os.File
+	ready *os.File
+}
+
+// Inherit returns listeners passed by the old process, false means the
+// process isn't started by a handover
+func Inherit() (*Inherited, bool, error) {
+	names := os.Getenv(envHandover)
+	if names == "" {
+		return nil, false, nil
+	}
+	// our own children must not think they are inheriting
+	os.Unsetenv(envHandover)
+	inherited := &Inherited{
+		state: os.NewFile(fdState, "state"),
+		ready: os.NewFile(fdReady, "ready"),
+	}
+	for i, name := range strings.Split(names, ",") {
+		l, err := sockets.FromFd(uintptr(fdListeners+i), name)
+		if err != nil {
+			inherited.Listeners.Close()
+			return nil, true, err
+		}
+		if !inherited.Listeners.set(name, l) {
+			l.Close()
+			inherited.Listeners.Close()
+			return nil, true, fmt.Errorf("unknown inherited listener %q", name)
+		}
+	}
+	return inherited, true, nil
+}
+
+// Ready tells the old process the new one serves, so it may stop accepting
+// and drain
+func (i *Inherited) Ready() error {
+	defer i.ready.Close()
+	if _, err := i.ready.Write([]byte{1}); err != nil {
+		return fmt.Errorf("unable to tell the old process we are ready: %v", err)
+	}
+	return nil
+}
+
+// ReadState waits until the old process has drained its clients and returns
+// the stack items it had, from the bottom to the top
+func (i *Inherited) ReadState() ([][]byte, error) {
+	defer i.state.Close()
+	st := state{}
+	if err := json.NewDecoder(i.state).Decode(&st); err != nil {
+		return nil, fmt.Errorf("unable to read state from the old process: %v", err)
+	}
+	return st.Items, nil
+}
+
+// Transfer represents a handover in progress on the old process side
+type Transfer struct {
+	cmd   *exec.Cmd
+	state *os.File
+	ready *os.File
+	// names and files are the passed listeners, they are kept to serve again
+	// if the handover fails
+	names []string
+	files []*os.File
+}
+
+// Start starts a new process from the current binary on disk with the same
+// arguments and passes the listeners to it. The old process keeps its own
+// listeners and serves until the new one is ready
+func Start(ls Listeners) (*Transfer, error) {
+	t := &Transfer{}
+	for _, named := range ls.byName() {
+		if *named.ln == nil {
+			continue
+		}
+		f, err := (*named.ln).File()
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("unable to get %s listener file: %v", named.name, err)
+		}
+		t.names = append(t.names, named.name)
+		t.files = append(t.files, f)
+	}
+	stateR, stateW, err := os.Pipe()
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("unable to create state pipe: %v", err)
+	}
+	defer stateR.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		stateW.Close()
+		t.Close()
+		return nil, fmt.Errorf("unable to create ready pipe: %v", err)
+	}
+	// the new process holds the only write end, so its exit is EOF here
+	defer readyW.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		stateW.Close()
+		readyR.Close()
+		t.Close()
+		return nil, fmt.Errorf("unable to find the executable: %v", err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), envHandover+"="+strings.Join(t.names, ","))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append([]*os.File{stateR, readyW}, t.files...)
+	if err := cmd.Start(); err != nil {
+		stateW.Close()
+		readyR.Close()
+		t.Close()
+		return nil, fmt.Errorf("unable to start the new process: %v", err)
+	}
+	t.cmd, t.state, t.ready = cmd, stateW, readyR
+	return t, nil
+}
+
+// Pid returns the new process id
+func (t *Transfer) Pid() int {
+	return t.cmd.Process.Pid
+}
+
+// WaitReady waits until the new process serves, it fails if the process
+// exits or isn't ready within timeout
+func (t *Transfer) WaitReady(timeout time.Duration) error {
+	defer t.ready.Close()
+	t.ready.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := t.ready.Read(make([]byte, 1)); err != nil {
+		return fmt.Errorf("new process isn't ready: %v", err)
+	}
+	return nil
+}
+
+// SendState passes the stack items, from the bottom to the top, to the new
+// process which starts serving its requests once it gets them
+func (t *Transfer) SendState(items [][]byte) error {
+	defer t.state.Close()
+	if err := json.NewEncoder(t.state).Encode(state{Items: items}); err != nil {
+		return fmt.Errorf("unable to send state to the new process: %v", err)
+	}
+	return nil
+}
+
+// Abort kills the new process, the old one may serve the listeners returned
+// by Listeners again
+func (t *Transfer) Abort() {
+	t.cmd.Process.Kill()
+	t.cmd.Wait()
+	t.ready.Close()
+	t.state.Close()
+}
+
+// Listeners returns new copies of the listeners passed to the new process
+func (t *Transfer) Listeners() (Listeners, error) {
+	ls := Listeners{}
+	for i, f := range t.files {
+		l, err := sockets.FromFile(f, t.names[i])
+		if err != nil {
+			ls.Close()
+			return Listeners{}, err
+		}
+		ls.set(t.names[i], l)
+	}
+	return ls, nil
+}
+
+// Close releases the listener copies kept for Listeners
+func (t *Transfer) Close() {
+	for _, f := range t.files {
+		f.Close()
+	}
+	t.files = nil
+}
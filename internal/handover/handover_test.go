@@ -0,0 +1,163 @@
+package handover
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// envChild tells the test binary started by Start how to behave as the new
+// process: "serve" gets ready and serves the state it reads, "fail" exits
+// before getting ready
+const envChild = "HANDOVER_TEST_CHILD"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(envHandover) != "" {
+		os.Exit(child())
+	}
+	os.Exit(m.Run())
+}
+
+// child is the new process, it answers a connection to the service listener
+// with the items it got and one to the control listener with "ok"
+func child() int {
+	inherited, ok, err := Inherit()
+	if err != nil || !ok || os.Getenv(envChild) == "fail" {
+		return 1
+	}
+	if err := inherited.Ready(); err != nil {
+		return 1
+	}
+	items, err := inherited.ReadState()
+	if err != nil {
+		return 1
+	}
+	c, err := inherited.Service.Accept()
+	if err != nil {
+		return 1
+	}
+	json.NewEncoder(c).Encode(items)
+	c.Close()
+	if c, err = inherited.Control.Accept(); err != nil {
+		return 1
+	}
+	c.Write([]byte("ok"))
+	c.Close()
+	return 0
+}
+
+func testListeners(t *testing.T) Listeners {
+	ls := Listeners{}
+	for _, l := range []**net.TCPListener{&ls.Service, &ls.Control} {
+		ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("listen error = %v", err)
+		}
+		*l = ln
+	}
+	return ls
+}
+
+func dial(t *testing.T, l *net.TCPListener) net.Conn {
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error = %v", err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c
+}
+
+func TestHandover(t *testing.T) {
+	os.Setenv(envChild, "serve")
+	defer os.Unsetenv(envChild)
+	ls := testListeners(t)
+	transfer, err := Start(ls)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer transfer.Close()
+	if err := transfer.WaitReady(5 * time.Second); err != nil {
+		t.Fatalf("WaitReady() error = %v", err)
+	}
+	items := [][]byte{[]byte("a"), []byte("b")}
+	if err := transfer.SendState(items); err != nil {
+		t.Fatalf("SendState() error = %v", err)
+	}
+	// the old process stops accepting, clients get to the new one
+	ls.Close()
+
+	c := dial(t, ls.Service)
+	defer c.Close()
+	var got [][]byte
+	if err := json.NewDecoder(c).Decode(&got); err != nil {
+		t.Fatalf("unable to read the new process state: %v", err)
+	}
+	if !reflect.DeepEqual(got, items) {
+		t.Errorf("new process got %q, want %q", got, items)
+	}
+	ctl := dial(t, ls.Control)
+	defer ctl.Close()
+	resp := make([]byte, 2)
+	if _, err := ctl.Read(resp); err != nil || string(resp) != "ok" {
+		t.Errorf("control response = %q, %v, want ok", resp, err)
+	}
+	if err := transfer.cmd.Wait(); err != nil {
+		t.Errorf("new process exited with %v", err)
+	}
+}
+
+func TestHandover_rollback(t *testing.T) {
+	tests := []struct {
+		name  string
+		child string
+		// ready is whether the new process gets ready before it's gone
+		ready bool
+	}{
+		{"exits before ready", "fail", false},
+		{"exits after ready", "serve", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv(envChild, tt.child)
+			defer os.Unsetenv(envChild)
+			ls := testListeners(t)
+			transfer, err := Start(ls)
+			if err != nil {
+				t.Fatalf("Start() error = %v", err)
+			}
+			defer transfer.Close()
+			err = transfer.WaitReady(5 * time.Second)
+			if (err == nil) != tt.ready {
+				t.Fatalf("WaitReady() error = %v, want ready %v", err, tt.ready)
+			}
+			if tt.ready {
+				// the new process dies before it gets the state
+				transfer.cmd.Process.Kill()
+				transfer.cmd.Wait()
+				if err := transfer.SendState([][]byte{[]byte("a")}); err == nil {
+					t.Fatalf("SendState() to a dead process succeeded")
+				}
+			}
+			transfer.Abort()
+			ls.Close()
+
+			// the old process serves again on copies of the same sockets
+			again, err := transfer.Listeners()
+			if err != nil {
+				t.Fatalf("Listeners() error = %v", err)
+			}
+			defer again.Close()
+			if again.Service.Addr().String() != ls.Service.Addr().String() || again.Admin != nil {
+				t.Fatalf("Listeners() = %v, want the ones passed", again)
+			}
+			c := dial(t, again.Service)
+			defer c.Close()
+			if _, err := again.Service.Accept(); err != nil {
+				t.Errorf("reopened listener doesn't accept: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types of the Prometheus text format
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// DefaultWaitBuckets are upper bounds in seconds for request wait times,
+// blocked requests wait from milliseconds up to minutes
+var DefaultWaitBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Histogram counts observations in buckets, it's safe for concurrent use
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// HistogramSnapshot represents a histogram state, Counts are per bucket and
+// not cumulative
+type HistogramSnapshot struct {
+	Bounds []float64
+	Counts []uint64
+	Sum    float64
+	Count  uint64
+}
+
+// NewHistogram a Histogram constructor, bounds are bucket upper bounds in
+// increasing order
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+// Observe adds a single observation
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+// Snapshot returns a copy of the histogram state
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts := make([]uint64, len(h.counts))
+	copy(counts, h.counts)
+	return HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: counts,
+		Sum:    h.sum,
+		Count:  h.count,
+	}
+}
+
+// Text writes metrics in the Prometheus text exposition format, the first
+// write error is kept and returned by Err
+type Text struct {
+	w   io.Writer
+	err error
+}
+
+// NewText a Text constructor
+func NewText(w io.Writer) *Text {
+	return &Text{w: w}
+}
+
+// Family starts a metric family, every sample of the family has to follow
+func (t *Text) Family(name, typ, help string) {
+	t.printf("# HELP %s %s\n", name, help)
+	t.printf("# TYPE %s %s\n", name, typ)
+}
+
+// Value writes a single sample, labels are name and value pairs
+func (t *Text) Value(name string, v float64, labels ...string) {
+	t.printf("%s%s %s\n", name, formatLabels(labels), formatFloat(v))
+}
+
+// Histogram writes buckets, sum and count samples of a histogram
+func (t *Text) Histogram(name string, s HistogramSnapshot, labels ...string) {
+	var cumulative uint64
+	for i, bound := range s.Bounds {
+		cumulative += s.Counts[i]
+		t.Value(name+"_bucket", float64(cumulative), append(labels, "le", formatFloat(bound))...)
+	}
+	t.Value(name+"_bucket", float64(s.Count), append(labels, "le", "+Inf")...)
+	t.Value(name+"_sum", s.Sum, labels...)
+	t.Value(name+"_count", float64(s.Count), labels...)
+}
+
+// Err returns the first write error
+func (t *Text) Err() error {
+	return t.err
+}
+
+func (t *Text) printf(format string, args ...interface{}) {
+	if t.err != nil {
+		return
+	}
+	_, t.err = fmt.Fprintf(t.w, format, args...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHistogram_Observe(t *testing.T) {
+	h := NewHistogram([]float64{1, 5})
+	for _, v := range []float64{0.5, 1, 3, 10} {
+		h.Observe(v)
+	}
+	s := h.Snapshot()
+	want := []uint64{2, 1}
+	for i := range want {
+		if s.Counts[i] != want[i] {
+			t.Errorf("bucket %g count = %d, want %d", s.Bounds[i], s.Counts[i], want[i])
+		}
+	}
+	if s.Count != 4 || s.Sum != 14.5 {
+		t.Errorf("count, sum = %d, %g, want 4, 14.5", s.Count, s.Sum)
+	}
+}
+
+func TestText(t *testing.T) {
+	h := NewHistogram([]float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(2)
+	b := &strings.Builder{}
+	text := NewText(b)
+	text.Family("requests_total", TypeCounter, "Requests served.")
+	text.Value("requests_total", 3, "op", "push")
+	text.Value("requests_total", 0.5, "op", `p"op`)
+	text.Family("wait_seconds", TypeHistogram, "Wait time.")
+	text.Histogram("wait_seconds", h.Snapshot(), "op", "pop")
+	want := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{op="push"} 3
+requests_total{op="p\"op"} 0.5
+# HELP wait_seconds Wait time.
+# TYPE wait_seconds histogram
+wait_seconds_bucket{op="pop",le="0.1"} 1
+wait_seconds_bucket{op="pop",le="1"} 1
+wait_seconds_bucket{op="pop",le="+Inf"} 2
+wait_seconds_sum{op="pop"} 2.05
+wait_seconds_count{op="pop"} 2
+`
+	if text.Err() != nil {
+		t.Fatalf("Err() = %v", text.Err())
+	}
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
@@ -0,0 +1,38 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow("10.0.0.1") {
+			t.Fatalf("request %d within burst is throttled", i)
+		}
+	}
+	if l.Allow("10.0.0.1") {
+		t.Fatalf("request over burst isn't throttled")
+	}
+	if !l.Allow("10.0.0.2") {
+		t.Fatalf("other key is throttled")
+	}
+	// 2 tokens per second, half a second gives one token back
+	now = now.Add(500 * time.Millisecond)
+	if !l.Allow("10.0.0.1") {
+		t.Fatalf("refilled token isn't granted")
+	}
+	if l.Allow("10.0.0.1") {
+		t.Fatalf("more tokens granted than refilled")
+	}
+	// idle buckets are swept once they are full
+	now = now.Add(2 * sweepInterval)
+	l.Allow("10.0.0.3")
+	if _, ok := l.buckets["10.0.0.1"]; ok {
+		t.Fatalf("idle bucket isn't swept")
+	}
+}
@@ -1,8 +1,9 @@
 package formatter
 
 import (
-	"fmt"
 	"strconv"
+
+	"github.com/sKudryashov/stacksrv/pkg/frame"
 )
 
 const (
@@ -13,21 +14,35 @@ const (
 	ActionPop = "1"
 )
 
+// Response codes are the ones of pkg/frame, which clients use as well
+const (
+	RespOK              = frame.RespOK
+	RespBusy            = frame.RespBusy
+	RespDenied          = frame.RespDenied
+	RespUnauthenticated = frame.RespUnauthenticated
+	RespRateLimited     = frame.RespRateLimited
+	RespShuttingDown    = frame.RespShuttingDown
+)
+
+// ActionName returns a human readable action name, "-" when it's not known yet
+func ActionName(action string) string {
+	switch action {
+	case ActionPush:
+		return "push"
+	case ActionPop:
+		return "pop"
+	default:
+		return "-"
+	}
+}
+
 // ParseRequest parses the first request byte
 func ParseRequest(header byte) (string, int64, error) {
-	actionStr := fmt.Sprintf("%08b", header)
-	action := actionStr[0]
-	payloadLnStr := actionStr[1:]
-	payloadLnInt, err := strconv.ParseInt(payloadLnStr, 2, 16)
-	actionStr = string(action)
-	return actionStr, payloadLnInt, err
+	op, n := frame.DecodeHeader(header)
+	return strconv.Itoa(int(op)), int64(n), nil
 }
 
 // FormatPopResponse formats rsp for pop
 func FormatPopResponse(data []byte) []byte {
-	ln := len(data)
-	response := make([]byte, 0, ln+1)
-	response = append(response, byte(int64(ln)))
-	response = append(response, data...)
-	return response
+	return frame.EncodePopResponse(data)
 }
@@ -3,9 +3,17 @@ package service
 import (
 	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/sKudryashov/stacksrv/internal/audit"
+	"github.com/sKudryashov/stacksrv/internal/auth"
+	"github.com/sKudryashov/stacksrv/internal/metrics"
 	"github.com/sKudryashov/stacksrv/internal/service/formatter"
+	"github.com/sKudryashov/stacksrv/internal/tap"
+	"github.com/sKudryashov/stacksrv/internal/trace"
+	"github.com/sKudryashov/stacksrv/pkg/config"
 	"github.com/sKudryashov/stacksrv/pkg/logger"
 	"github.com/sKudryashov/stacksrv/pkg/stack"
 )
@@ -15,99 +23,499 @@ type ErrAction struct {
 	error
 }
 
+// ErrDenied represents an error when the client isn't allowed to run the action
+type ErrDenied struct {
+	error
+}
+
 // WriterAPI represents API in which we can write
 type WriterAPI interface {
 	SetActive(bool)
 	IsActive() bool
 	CheckIsActive() bool
+	MarkBlocked()
 	WritePushResponse()
 	WriteBusyState()
 	WritePopResponse([]byte)
+	WriteDenied()
+	WriteShuttingDown()
+	WriteErr()
 	GetAction() string
+	GetIdentity() string
 	GetData() []byte
 	GetID() int
+	Remote() string
+	Log() logger.Logger
+	Trace() *trace.Trace
 }
 
 // Queue service operates on queue on a highlevel providing any business logic on top of
 // the data structure itself
 type Queue struct {
+	// mu is held by every stack operation along with its audit record, so
+	// the audit log follows the stack order and a reset is atomic against
+	// requests being processed
+	mu          sync.Mutex
 	st          *stack.Stack
 	waitReadCh  chan WriterAPI
-	waitWriteCh chan stack.WaitConnAPI
+	waitWriteCh chan WriterAPI
 	readWait    []WriterAPI
 	writeWait   []WriterAPI
+	policy      *auth.Policy
+	log         logger.Logger
+	audit       *audit.Log
+	tap         *tap.Hub
+	// pushes and pops count answered requests, blocked ones included
+	pushes    uint64
+	pops      uint64
+	pushWaits *metrics.Histogram
+	popWaits  *metrics.Histogram
+	// waiterRejections count requests answered with busy as too many are
+	// blocked already
+	waiterRejections uint64
+	// held is closed once requests held by Hold may go on
+	held chan struct{}
+	// doneCh stops the blocked pops worker
+	doneCh <-chan interface{}
+}
+
+// QueueStats represents queue counters, waits are in seconds and cover
+// requests which were blocked only
+type QueueStats struct {
+	Pushes           uint64
+	Pops             uint64
+	WaiterRejections uint64
+	PushWaits        metrics.HistogramSnapshot
+	PopWaits         metrics.HistogramSnapshot
+}
+
+// waiter is a blocked request, it's counted along with the time it waited
+// once it's answered
+type waiter struct {
+	WriterAPI
+	since time.Time
+	q     *Queue
+}
+
+func (w *waiter) WritePushResponse() {
+	w.Trace().End(trace.SpanBlocked)
+	atomic.AddUint64(&w.q.pushes, 1)
+	w.q.record(audit.OpPush, w.WriterAPI, w.GetData())
+	w.q.tap.Publishf(tap.Woken, w.GetID(), "push len=%d", len(w.GetData()))
+	w.q.pushWaits.Observe(time.Since(w.since).Seconds())
+	w.WriterAPI.WritePushResponse()
+}
+
+func (w *waiter) WritePopResponse(data []byte) {
+	w.Trace().End(trace.SpanBlocked)
+	atomic.AddUint64(&w.q.pops, 1)
+	w.q.record(audit.OpPop, w.WriterAPI, data)
+	w.q.tap.Publishf(tap.Woken, w.GetID(), "pop len=%d", len(data))
+	w.q.popWaits.Observe(time.Since(w.since).Seconds())
+	w.WriterAPI.WritePopResponse(data)
+}
+
+// unwrap returns the request a waiter was made for
+func unwrap(conn WriterAPI) WriterAPI {
+	if w, ok := conn.(*waiter); ok {
+		return w.WriterAPI
+	}
+	return conn
 }
 
-// NewQService constructor
-func NewQService() *Queue {
-	wwr := make(chan stack.WaitConnAPI, 100)
+// NewQService constructor, the worker serving blocked pops runs until doneCh
+// is closed
+func NewQService(doneCh <-chan interface{}, cfg config.Stack) *Queue {
 	q := &Queue{
-		st:          stack.NewStack(wwr),
+		st:          stack.NewStack(cfg.Capacity),
 		waitReadCh:  make(chan WriterAPI, 100),
-		waitWriteCh: wwr,
+		waitWriteCh: make(chan WriterAPI, 100),
+		log:         logger.App,
+		pushWaits:   metrics.NewHistogram(metrics.DefaultWaitBuckets),
+		popWaits:    metrics.NewHistogram(metrics.DefaultWaitBuckets),
+		doneCh:      doneCh,
 	}
 	go q.processWaits()
 	return q
 }
 
+// Stats returns queue counters
+func (q *Queue) Stats() QueueStats {
+	return QueueStats{
+		Pushes:           atomic.LoadUint64(&q.pushes),
+		Pops:             atomic.LoadUint64(&q.pops),
+		WaiterRejections: atomic.LoadUint64(&q.waiterRejections),
+		PushWaits:        q.pushWaits.Snapshot(),
+		PopWaits:         q.popWaits.Snapshot(),
+	}
+}
+
+// SetLogger sets the logger for lines not about a single request, it's not
+// safe to call once the queue is in use
+func (q *Queue) SetLogger(l logger.Logger) {
+	q.log = l
+	q.st.SetLogger(l)
+}
+
+// SetAudit sets the log every stack mutation is recorded to, nil disables
+// it. It's not safe to call once the queue is in use
+func (q *Queue) SetAudit(a *audit.Log) {
+	q.audit = a
+}
+
+// SetTap sets the hub pushes, pops, blocked and woken requests are
+// published to, nil disables it. It's not safe to call once the queue is in
+// use
+func (q *Queue) SetTap(h *tap.Hub) {
+	q.tap = h
+}
+
+// record writes a client operation to the audit log, a failed write is
+// logged and doesn't fail the request
+func (q *Queue) record(op string, conn WriterAPI, payload []byte) {
+	if q.audit == nil {
+		return
+	}
+	if err := q.audit.Record(audit.NewEntry(op, conn.GetID(), conn.Remote(), payload)); err != nil {
+		conn.Log().Error(err.Error())
+	}
+}
+
+// recordItems writes a server operation on n items to the audit log
+func (q *Queue) recordItems(op string, n int) {
+	if q.audit == nil {
+		return
+	}
+	if err := q.audit.Record(audit.Entry{Time: time.Now().UTC(), Op: op, Items: n}); err != nil {
+		q.log.Error(err.Error())
+	}
+}
+
+// Hold makes requests wait until Release, e.g. while the stack is being
+// restored. It's not safe to call once the queue is in use
+func (q *Queue) Hold() {
+	q.held = make(chan struct{})
+}
+
+// Release lets the requests held by Hold go on
+func (q *Queue) Release() {
+	if q.held != nil {
+		close(q.held)
+	}
+}
+
+// SetPolicy sets identity permissions policy, nil disables the check
+func (q *Queue) SetPolicy(p *auth.Policy) {
+	q.policy = p
+}
+
+// SetCapacity changes the stack capacity of a running queue
+func (q *Queue) SetCapacity(capacity int) {
+	q.mu.Lock()
+	q.st.SetCapacity(capacity)
+	q.serveWaitingWriteL()
+	q.mu.Unlock()
+}
+
+// WouldBlock returns whether the action can't be served right away: pop on
+// an empty stack or push on a full one
+func (q *Queue) WouldBlock(action string) bool {
+	switch action {
+	case formatter.ActionPop:
+		return q.st.IsEmpty()
+	case formatter.ActionPush:
+		return q.st.Len() >= q.st.Cap()
+	default:
+		return false
+	}
+}
+
 func (q *Queue) processWaits() {
 	for {
-		time.Sleep(time.Second * 1)
-		if len(q.waitReadCh) > 0 {
-			if d, ok := q.st.Pop(); ok {
-				data := d.([]byte)
-				select {
-				case conn := <-q.waitReadCh:
-					if conn.CheckIsActive() {
-						conn.WritePopResponse(data)
-					}
-				}
-			}
+		select {
+		case <-q.doneCh:
+			q.log.Info("queue waits processor stopped")
+			return
+		case <-time.After(time.Second * 1):
 		}
+		q.mu.Lock()
+		q.serveWaitingReadL()
+		q.mu.Unlock()
 	}
 }
 
-func (q *Queue) addWaitingRead(conn WriterAPI) {
-	q.waitReadCh <- conn
+// serveWaitingReadL answers the first blocked pop which is still there with
+// the top item, the ones gone meanwhile (kicked or evicted) are dropped
+// without touching the stack. The caller holds the lock, so nothing is
+// pushed or popped in between
+func (q *Queue) serveWaitingReadL() {
+	for len(q.waitReadCh) > 0 && !q.st.IsEmpty() {
+		conn := <-q.waitReadCh
+		if !conn.CheckIsActive() {
+			conn.Log().Debugf("blocked pop %d is gone", conn.GetID())
+			continue
+		}
+		data, _ := q.st.Pop()
+		conn.WritePopResponse(data.([]byte))
+		return
+	}
 }
 
-func (q *Queue) addWaitingWrite(conn WriterAPI) {
-	q.waitWriteCh <- conn
+// serveWaitingWriteL pushes the blocked pushes which are still there while
+// the stack has room, the ones gone meanwhile are dropped. The caller holds
+// the lock, so a push made room for by a pop is recorded after the pop
+func (q *Queue) serveWaitingWriteL() {
+	for len(q.waitWriteCh) > 0 && q.st.Len() < q.st.Cap() {
+		conn := <-q.waitWriteCh
+		if !conn.CheckIsActive() {
+			conn.Log().Debugf("blocked push %d is gone", conn.GetID())
+			continue
+		}
+		data := conn.GetData()
+		conn.Log().Infof("waiting push writes data to the stack %s", string(data))
+		q.st.Push(data)
+		conn.WritePushResponse()
+	}
+}
+
+// takeWaitersL is a lock-free removal of every blocked push and pop
+func (q *Queue) takeWaitersL() []WriterAPI {
+	var taken []WriterAPI
+	for {
+		select {
+		case conn := <-q.waitReadCh:
+			taken = append(taken, unwrap(conn))
+		case conn := <-q.waitWriteCh:
+			taken = append(taken, unwrap(conn))
+		default:
+			return taken
+		}
+	}
+}
+
+// DrainWaiters answers every blocked push and pop with the shutting down
+// response and returns them so the caller can release them
+func (q *Queue) DrainWaiters() []WriterAPI {
+	q.mu.Lock()
+	drained := q.takeWaitersL()
+	q.mu.Unlock()
+	for _, conn := range drained {
+		conn.Log().Infof("blocked %s request %d is answered with shutting down", conn.GetAction(), conn.GetID())
+		conn.WriteShuttingDown()
+	}
+	return drained
+}
+
+// BounceWaiters answers every blocked push and pop with busy, so clients retry
+// them while the server keeps running, and returns them so the caller can
+// release them
+func (q *Queue) BounceWaiters() []WriterAPI {
+	q.mu.Lock()
+	bounced := q.takeWaitersL()
+	q.mu.Unlock()
+	for _, conn := range bounced {
+		conn.Log().Infof("blocked %s request %d is answered with busy", conn.GetAction(), conn.GetID())
+		conn.WriteBusyState()
+		conn.WriteErr()
+	}
+	return bounced
+}
+
+// ClearStack drops every item from the stack, it returns the number of dropped
+// items
+func (q *Queue) ClearStack() int {
+	q.mu.Lock()
+	n := q.st.Clear()
+	q.recordItems(audit.OpClear, n)
+	q.mu.Unlock()
+	q.log.Infof("stack cleared, %d items dropped", n)
+	return n
+}
+
+// ClearWaiters disconnects every blocked push and pop and returns them so the
+// caller can release them
+func (q *Queue) ClearWaiters() []WriterAPI {
+	q.mu.Lock()
+	cleared := q.takeWaitersL()
+	q.mu.Unlock()
+	for _, conn := range cleared {
+		conn.WriteErr()
+	}
+	q.log.Infof("waiters cleared, %d requests disconnected", len(cleared))
+	return cleared
+}
+
+// Reset clears the stack, disconnects blocked requests and calls release
+// with them in one go, no request is processed or gets blocked until release
+// returns. It returns the number of dropped items and disconnected requests
+func (q *Queue) Reset(release func(cleared []WriterAPI)) (int, []WriterAPI) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := q.st.Clear()
+	cleared := q.takeWaitersL()
+	q.recordItems(audit.OpClear, n)
+	for _, conn := range cleared {
+		conn.WriteErr()
+	}
+	release(cleared)
+	q.log.Infof("queue reset, %d items dropped, %d requests disconnected", n, len(cleared))
+	return n, cleared
+}
+
+// Waiters returns the number of blocked pops and pushes
+func (q *Queue) Waiters() (int, int) {
+	return len(q.waitReadCh), len(q.waitWriteCh)
+}
+
+// Len returns the number of items on the stack
+func (q *Queue) Len() int {
+	return q.st.Len()
+}
+
+// Bytes returns the total payload size of the stack items
+func (q *Queue) Bytes() int {
+	return q.st.Bytes()
+}
+
+// Cap returns the stack capacity
+func (q *Queue) Cap() int {
+	return q.st.Cap()
+}
+
+// Snapshot returns the stack items from the bottom to the top
+func (q *Queue) Snapshot() [][]byte {
+	q.mu.Lock()
+	items := q.st.Items()
+	q.mu.Unlock()
+	snapshot := make([][]byte, 0, len(items))
+	for _, item := range items {
+		snapshot = append(snapshot, item.([]byte))
+	}
+	return snapshot
+}
+
+// Restore replaces the stack items with a snapshot taken by Snapshot
+func (q *Queue) Restore(snapshot [][]byte) {
+	items := make([]interface{}, 0, len(snapshot))
+	for _, item := range snapshot {
+		items = append(items, item)
+	}
+	q.mu.Lock()
+	q.st.Restore(items)
+	q.recordItems(audit.OpRestore, len(items))
+	q.mu.Unlock()
+	q.log.Infof("stack restored with %d items", len(items))
+}
+
+// addWaitingRead blocks the pop until an item is pushed, it's called with
+// the lock held so it must not wait: false means there are too many blocked
+// pops already
+func (q *Queue) addWaitingRead(conn WriterAPI) bool {
+	conn.MarkBlocked()
+	conn.Trace().Start(trace.SpanBlocked)
+	q.tap.Publish(tap.Blocked, conn.GetID(), "pop")
+	select {
+	case q.waitReadCh <- &waiter{WriterAPI: conn, since: time.Now(), q: q}:
+		return true
+	default:
+		conn.Trace().End(trace.SpanBlocked)
+		return false
+	}
+}
+
+// addWaitingWrite blocks the push until there's room, it's called with the
+// lock held so it must not wait: false means there are too many blocked
+// pushes already
+func (q *Queue) addWaitingWrite(conn WriterAPI) bool {
+	conn.MarkBlocked()
+	conn.Trace().Start(trace.SpanBlocked)
+	q.tap.Publishf(tap.Blocked, conn.GetID(), "push len=%d", len(conn.GetData()))
+	select {
+	case q.waitWriteCh <- &waiter{WriterAPI: conn, since: time.Now(), q: q}:
+		return true
+	default:
+		conn.Trace().End(trace.SpanBlocked)
+		return false
+	}
+}
+
+// writeTooManyWaiters answers a request which can't be blocked with busy
+func (q *Queue) writeTooManyWaiters(conn WriterAPI) {
+	conn.Log().Infof("too many blocked %s requests, conn %d gets busy", formatter.ActionName(conn.GetAction()), conn.GetID())
+	atomic.AddUint64(&q.waiterRejections, 1)
+	q.tap.Publish(tap.Busy, conn.GetID(), "too many blocked requests")
+	conn.WriteBusyState()
+	conn.WriteErr()
 }
 
 // ProcessRequest processes single queue request
 func (q *Queue) ProcessRequest(ctx context.Context, conn WriterAPI) (bool, error) {
+	if q.held != nil {
+		select {
+		case <-q.held:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
 	action := conn.GetAction()
+	if q.policy != nil && !q.policy.Allowed(conn.GetIdentity(), action) {
+		conn.WriteDenied()
+		return false, ErrDenied{fmt.Errorf("identity %q isn't allowed to run action %s", conn.GetIdentity(), action)}
+	}
 	switch action {
 	case formatter.ActionPop:
-		logger.App.Debugf("action POP")
+		conn.Log().Debugf("action POP")
 		if !conn.CheckIsActive() {
-			logger.App.Debugf("connection is not active and can't be processed %d", conn.GetID())
+			conn.Log().Debugf("connection is not active and can't be processed %d", conn.GetID())
 			return false, nil
 		}
+		// the lock is held until the pop is blocked, so a reset doesn't miss it
+		q.mu.Lock()
 		data, ok := q.st.Pop()
 		if !ok {
-			logger.App.Debugf("there is nothing to read, waiting")
-			q.addWaitingRead(conn)
+			conn.Log().Debugf("there is nothing to read, waiting")
+			blocked := q.addWaitingRead(conn)
+			q.mu.Unlock()
+			if !blocked {
+				q.writeTooManyWaiters(conn)
+				return true, nil
+			}
 			return false, nil
 		}
 		dataByte := data.([]byte)
-		logger.App.Infof("POP from the stack %s", string(dataByte))
+		q.record(audit.OpPop, conn, dataByte)
+		// the pop made room for a blocked push
+		q.serveWaitingWriteL()
+		q.mu.Unlock()
+		conn.Log().Infof("POP from the stack %s", string(dataByte))
+		atomic.AddUint64(&q.pops, 1)
+		q.tap.Publishf(tap.Pop, conn.GetID(), "len=%d", len(dataByte))
 		conn.WritePopResponse(dataByte)
 
 		return true, nil
 	case formatter.ActionPush:
 		if !conn.CheckIsActive() {
-			logger.App.Debugf("connection is not active and can't be processed %d", conn.GetID())
+			conn.Log().Debugf("connection is not active and can't be processed %d", conn.GetID())
 			return false, nil
 		}
 		data := conn.GetData()
-		if ok := q.st.Push(data); !ok {
-			logger.App.Infof("no place to push %s left, waiting", string(data))
-			q.addWaitingWrite(conn)
+		q.mu.Lock()
+		ok := q.st.Push(data)
+		if !ok {
+			conn.Log().Infof("no place to push %s left, waiting", string(data))
+			blocked := q.addWaitingWrite(conn)
+			q.mu.Unlock()
+			if !blocked {
+				q.writeTooManyWaiters(conn)
+				return true, nil
+			}
 			return false, nil
 		}
-		logger.App.Infof("data PUSHed to the stack %s", string(data))
+		q.record(audit.OpPush, conn, data)
+		q.mu.Unlock()
+		conn.Log().Infof("data PUSHed to the stack %s", string(data))
+		atomic.AddUint64(&q.pushes, 1)
+		q.tap.Publishf(tap.Push, conn.GetID(), "len=%d", len(data))
 		conn.SetActive(false)
 		conn.WritePushResponse()
 
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sKudryashov/stacksrv/internal/audit"
+	"github.com/sKudryashov/stacksrv/internal/service/formatter"
+	"github.com/sKudryashov/stacksrv/internal/trace"
+	"github.com/sKudryashov/stacksrv/pkg/config"
+	"github.com/sKudryashov/stacksrv/pkg/logger"
+)
+
+// fakeConn is a request which is always active and keeps what it's answered
+type fakeConn struct {
+	id     int
+	action string
+	data   []byte
+	popped []byte
+	pushed bool
+}
+
+func (c *fakeConn) SetActive(bool)            {}
+func (c *fakeConn) IsActive() bool            { return true }
+func (c *fakeConn) CheckIsActive() bool       { return true }
+func (c *fakeConn) MarkBlocked()              {}
+func (c *fakeConn) WritePushResponse()        { c.pushed = true }
+func (c *fakeConn) WriteBusyState()           {}
+func (c *fakeConn) WritePopResponse(d []byte) { c.popped = d }
+func (c *fakeConn) WriteDenied()              {}
+func (c *fakeConn) WriteShuttingDown()        {}
+func (c *fakeConn) WriteErr()                 {}
+func (c *fakeConn) GetAction() string         { return c.action }
+func (c *fakeConn) GetIdentity() string       { return "" }
+func (c *fakeConn) GetData() []byte           { return c.data }
+func (c *fakeConn) GetID() int                { return c.id }
+func (c *fakeConn) Remote() string            { return "127.0.0.1:5000" }
+func (c *fakeConn) Log() logger.Logger        { return logger.App }
+func (c *fakeConn) Trace() *trace.Trace       { return nil }
+
+func TestQueue_audit(t *testing.T) {
+	type want struct {
+		op     string
+		connID int
+		len    int
+	}
+	tests := []struct {
+		name     string
+		capacity int
+		requests []*fakeConn
+		want     []want
+	}{
+		{
+			name:     "push and pop",
+			capacity: 2,
+			requests: []*fakeConn{
+				{id: 1, action: formatter.ActionPush, data: []byte("a")},
+				{id: 2, action: formatter.ActionPop},
+			},
+			want: []want{{audit.OpPush, 1, 1}, {audit.OpPop, 2, 1}},
+		},
+		{
+			// the blocked push is recorded after the pop which made room
+			name:     "pop serves a blocked push",
+			capacity: 1,
+			requests: []*fakeConn{
+				{id: 1, action: formatter.ActionPush, data: []byte("a")},
+				{id: 2, action: formatter.ActionPush, data: []byte("bb")},
+				{id: 3, action: formatter.ActionPop},
+			},
+			want: []want{{audit.OpPush, 1, 1}, {audit.OpPop, 3, 1}, {audit.OpPush, 2, 2}},
+		},
+		{
+			name:     "blocked pop isn't recorded",
+			capacity: 1,
+			requests: []*fakeConn{
+				{id: 1, action: formatter.ActionPop},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "queue")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "audit.log")
+			l, err := audit.Open(path, 1<<20, 1)
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			cfg := config.Defaults()
+			cfg.Stack.Capacity = tt.capacity
+			done := make(chan interface{})
+			defer close(done)
+			q := NewQService(done, cfg.Stack)
+			q.SetAudit(l)
+			for _, conn := range tt.requests {
+				if _, err := q.ProcessRequest(context.Background(), conn); err != nil {
+					t.Fatalf("ProcessRequest() error = %v", err)
+				}
+			}
+			if err := l.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var got []want
+			sc := bufio.NewScanner(f)
+			for sc.Scan() {
+				var e audit.Entry
+				if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+					t.Fatalf("line %q isn't an entry: %v", sc.Text(), err)
+				}
+				got = append(got, want{e.Op, e.ConnID, e.Len})
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("audit log = %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("entry %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestQueue_tooManyWaiters(t *testing.T) {
+	done := make(chan interface{})
+	defer close(done)
+	q := NewQService(done, config.Defaults().Stack)
+	n := cap(q.waitReadCh)
+	for i := 0; i <= n; i++ {
+		answered, err := q.ProcessRequest(context.Background(), &fakeConn{id: i, action: formatter.ActionPop})
+		if err != nil {
+			t.Fatalf("ProcessRequest() error = %v", err)
+		}
+		if answered != (i == n) {
+			t.Fatalf("pop %d answered = %v, want only the one over %d blocked answered", i, answered, n)
+		}
+	}
+	if got := q.Stats().WaiterRejections; got != 1 {
+		t.Errorf("WaiterRejections = %d, want 1", got)
+	}
+}
@@ -0,0 +1,28 @@
+package sockets
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// FromFile returns a TCP listener on a copy of the socket f, f stays open
+func FromFile(f *os.File, name string) (*net.TCPListener, error) {
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use %s socket: %v", name, err)
+	}
+	tcpL, ok := l.(*net.TCPListener)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("%s socket isn't a TCP one", name)
+	}
+	return tcpL, nil
+}
+
+// FromFd returns a TCP listener on the socket fd, fd is closed either way
+func FromFd(fd uintptr, name string) (*net.TCPListener, error) {
+	f := os.NewFile(fd, name)
+	defer f.Close()
+	return FromFile(f, name)
+}
@@ -0,0 +1,51 @@
+package sockets
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestFromFile(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen error = %v", err)
+	}
+	defer ln.Close()
+	lnFile, err := ln.File()
+	if err != nil {
+		t.Fatalf("File() error = %v", err)
+	}
+	defer lnFile.Close()
+	regular, err := ioutil.TempFile("", "sockets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(regular.Name())
+	defer regular.Close()
+
+	tests := []struct {
+		name    string
+		f       *os.File
+		wantErr bool
+	}{
+		{"tcp socket", lnFile, false},
+		{"regular file", regular, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := FromFile(tt.f, tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FromFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer l.Close()
+			if l.Addr().String() != ln.Addr().String() {
+				t.Errorf("listener address = %s, want %s", l.Addr(), ln.Addr())
+			}
+		})
+	}
+}
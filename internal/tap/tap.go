@@ -0,0 +1,171 @@
+package tap
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types
+const (
+	Accepted = "accepted"
+	Header   = "header"
+	Push     = "push"
+	Pop      = "pop"
+	Blocked  = "blocked"
+	Woken    = "woken"
+	Evicted  = "evicted"
+	Busy     = "busy"
+	Quota    = "quota"
+	Closed   = "closed"
+)
+
+var types = map[string]bool{
+	Accepted: true,
+	Header:   true,
+	Push:     true,
+	Pop:      true,
+	Blocked:  true,
+	Woken:    true,
+	Evicted:  true,
+	Busy:     true,
+	Quota:    true,
+	Closed:   true,
+}
+
+// Event is something that happened to a client connection
+type Event struct {
+	Time   time.Time
+	Type   string
+	ConnID int
+	Detail string
+}
+
+// String formats the event as a single line: time, type, connection ID and
+// detail if any
+func (e Event) String() string {
+	s := fmt.Sprintf("%s %s %d", e.Time.Format(time.RFC3339Nano), e.Type, e.ConnID)
+	if e.Detail != "" {
+		s += " " + e.Detail
+	}
+	return s
+}
+
+// Filter is a set of event types, empty one matches every type
+type Filter map[string]bool
+
+// ParseFilter returns the filter of the given type names
+func ParseFilter(names []string) (Filter, error) {
+	f := make(Filter, len(names))
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if !types[name] {
+			return nil, fmt.Errorf("unknown event type %q, expected one of %s", name, strings.Join(Types(), ", "))
+		}
+		f[name] = true
+	}
+	return f, nil
+}
+
+// Types returns every event type name sorted
+func Types() []string {
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f Filter) matches(typ string) bool {
+	return len(f) == 0 || f[typ]
+}
+
+// Subscription receives the events matching its filter, events which don't
+// fit its buffer are dropped and counted
+type Subscription struct {
+	hub     *Hub
+	filter  Filter
+	ch      chan Event
+	dropped uint64
+}
+
+// Events returns the channel events are delivered to
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped returns the number of events dropped because the subscriber was
+// too slow
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close stops the delivery
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	delete(s.hub.subs, s)
+	atomic.StoreInt32(&s.hub.n, int32(len(s.hub.subs)))
+	s.hub.mu.Unlock()
+}
+
+// Hub delivers published events to subscribers, publishing never blocks. A
+// nil Hub drops everything, so publishers don't have to check
+type Hub struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]bool
+	// n is the number of subscribers, publishing is a single atomic load
+	// while nobody listens
+	n int32
+}
+
+// NewHub a Hub constructor
+func NewHub() *Hub {
+	return &Hub{subs: make(map[*Subscription]bool)}
+}
+
+// Subscribe starts delivering events matching f, buffer is the number of
+// events the subscriber may lag behind
+func (h *Hub) Subscribe(f Filter, buffer int) *Subscription {
+	s := &Subscription{hub: h, filter: f, ch: make(chan Event, buffer)}
+	h.mu.Lock()
+	h.subs[s] = true
+	atomic.StoreInt32(&h.n, int32(len(h.subs)))
+	h.mu.Unlock()
+	return s
+}
+
+// Publish delivers an event to every subscriber interested in typ
+func (h *Hub) Publish(typ string, connID int, detail string) {
+	if h == nil || atomic.LoadInt32(&h.n) == 0 {
+		return
+	}
+	h.publish(typ, connID, detail)
+}
+
+// Publishf is Publish with the detail formatted only if someone listens
+func (h *Hub) Publishf(typ string, connID int, format string, args ...interface{}) {
+	if h == nil || atomic.LoadInt32(&h.n) == 0 {
+		return
+	}
+	h.publish(typ, connID, fmt.Sprintf(format, args...))
+}
+
+func (h *Hub) publish(typ string, connID int, detail string) {
+	e := Event{Time: time.Now().UTC(), Type: typ, ConnID: connID, Detail: detail}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subs {
+		if !s.filter.matches(typ) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
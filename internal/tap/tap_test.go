@@ -0,0 +1,58 @@
+package tap
+
+import (
+	"testing"
+)
+
+func TestHub(t *testing.T) {
+	h := NewHub()
+	h.Publish(Push, 1, "nobody listens")
+	all := h.Subscribe(nil, 10)
+	pops, err := ParseFilter([]string{"POP", "woken"})
+	if err != nil {
+		t.Fatalf("ParseFilter() error = %v", err)
+	}
+	slow := h.Subscribe(pops, 1)
+
+	h.Publish(Push, 1, "len=3")
+	h.Publishf(Pop, 2, "len=%d", 3)
+	h.Publish(Woken, 3, "pop len=1")
+	all.Close()
+	h.Publish(Closed, 1, "")
+
+	tests := []struct {
+		name        string
+		sub         *Subscription
+		wantIDs     []int
+		wantDropped uint64
+	}{
+		{"all", all, []int{1, 2, 3}, 0},
+		{"pop and woken", slow, []int{2}, 1},
+	}
+	for _, tt := range tests {
+		var ids []int
+		for len(tt.sub.Events()) > 0 {
+			ids = append(ids, (<-tt.sub.Events()).ConnID)
+		}
+		if len(ids) != len(tt.wantIDs) {
+			t.Fatalf("%s got events of %v, want %v", tt.name, ids, tt.wantIDs)
+		}
+		for i := range ids {
+			if ids[i] != tt.wantIDs[i] {
+				t.Errorf("%s got events of %v, want %v", tt.name, ids, tt.wantIDs)
+			}
+		}
+		if got := tt.sub.Dropped(); got != tt.wantDropped {
+			t.Errorf("%s dropped = %d, want %d", tt.name, got, tt.wantDropped)
+		}
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	if _, err := ParseFilter([]string{"push", "write"}); err == nil {
+		t.Errorf("ParseFilter() accepts an unknown type")
+	}
+	var h *Hub
+	// a nil hub drops events
+	h.Publish(Push, 1, "")
+}
@@ -0,0 +1,293 @@
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sKudryashov/stacksrv/pkg/logger"
+)
+
+// Stages of a request, the spans a request trace is made of
+const (
+	SpanRequest       = "request"
+	SpanReadingQueue  = "reading_queue"
+	SpanOrdering      = "ordering"
+	SpanReadBody      = "read_body"
+	SpanBlocked       = "blocked"
+	SpanWriteResponse = "write_response"
+)
+
+// Stdout is the output name which makes the tracer write to stdout
+const Stdout = "stdout"
+
+// serviceName is the service.name resource attribute
+const serviceName = "stacksrv"
+
+// OTLP span kinds
+const (
+	kindInternal = 1
+	kindServer   = 2
+)
+
+// Tracer writes finished traces as OTLP JSON, one ExportTraceServiceRequest
+// per line, the format of the OpenTelemetry collector file exporter. A nil
+// Tracer traces nothing
+type Tracer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	log    logger.Logger
+}
+
+// NewTracer a Tracer constructor, export errors are logged to log
+func NewTracer(w io.Writer, log logger.Logger) *Tracer {
+	return &Tracer{w: w, log: log}
+}
+
+// Open returns a tracer appending to the file at output, or writing to
+// stdout if output is Stdout
+func Open(output string, log logger.Logger) (*Tracer, error) {
+	if output == Stdout {
+		return NewTracer(os.Stdout, log), nil
+	}
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open trace output %s: %v", output, err)
+	}
+	t := NewTracer(f, log)
+	t.closer = f
+	return t, nil
+}
+
+// Close closes the trace file, traces finished afterwards are dropped. It
+// does nothing once the tracer is closed
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.w = nil
+	if t.closer == nil {
+		return nil
+	}
+	err := t.closer.Close()
+	t.closer = nil
+	return err
+}
+
+// Start starts a trace with its root span named name
+func (t *Tracer) Start(name string) *Trace {
+	if t == nil {
+		return nil
+	}
+	tr := &Trace{
+		tracer: t,
+		id:     newID(16),
+		open:   make(map[string]*span),
+	}
+	tr.root = &span{id: newID(8), name: name, kind: kindServer, start: time.Now()}
+	return tr
+}
+
+func (t *Tracer) export(tr *Trace) {
+	line, err := json.Marshal(tr.otlp())
+	if err != nil {
+		t.log.Errorf("unable to encode trace: %v", err)
+		return
+	}
+	line = append(line, '\n')
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.w == nil {
+		return
+	}
+	if _, err := t.w.Write(line); err != nil {
+		t.log.Errorf("unable to write trace: %v", err)
+	}
+}
+
+type span struct {
+	id    string
+	name  string
+	kind  int
+	start time.Time
+	end   time.Time
+	attrs []keyValue
+}
+
+// Trace is a single request, its stages are child spans of the root one. A
+// nil Trace ignores every call, so callers don't have to check
+type Trace struct {
+	tracer *Tracer
+	id     string
+	mu     sync.Mutex
+	root   *span
+	spans  []*span
+	open   map[string]*span
+	done   bool
+}
+
+// Start starts the stage named name
+func (tr *Trace) Start(name string) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.done {
+		return
+	}
+	s := &span{id: newID(8), name: name, kind: kindInternal, start: time.Now()}
+	tr.open[name] = s
+	tr.spans = append(tr.spans, s)
+}
+
+// End ends the stage named name, it does nothing if the stage isn't started
+func (tr *Trace) End(name string) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if s, ok := tr.open[name]; ok {
+		s.end = time.Now()
+		delete(tr.open, name)
+	}
+}
+
+// SetAttr sets an attribute of the root span, value is a string, an int or
+// a bool
+func (tr *Trace) SetAttr(key string, value interface{}) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.root.attrs = append(tr.root.attrs, newKeyValue(key, value))
+}
+
+// Finish ends the root span and the stages still open and exports the
+// trace, only the first call counts
+func (tr *Trace) Finish() {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	if tr.done {
+		tr.mu.Unlock()
+		return
+	}
+	tr.done = true
+	now := time.Now()
+	for name, s := range tr.open {
+		s.end = now
+		delete(tr.open, name)
+	}
+	tr.root.end = now
+	tr.mu.Unlock()
+	tr.tracer.export(tr)
+}
+
+// OTLP JSON encoding, see opentelemetry-proto ExportTraceServiceRequest
+type (
+	otlpRequest struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}
+	resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	resource struct {
+		Attributes []keyValue `json:"attributes"`
+	}
+	scopeSpans struct {
+		Scope scope      `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	scope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		Name              string     `json:"name"`
+		Kind              int        `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []keyValue `json:"attributes,omitempty"`
+	}
+	keyValue struct {
+		Key   string   `json:"key"`
+		Value anyValue `json:"value"`
+	}
+	// anyValue has one field set, 64 bit integers are strings in OTLP JSON
+	anyValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+		BoolValue   *bool   `json:"boolValue,omitempty"`
+	}
+)
+
+func newKeyValue(key string, value interface{}) keyValue {
+	kv := keyValue{Key: key}
+	switch v := value.(type) {
+	case string:
+		kv.Value.StringValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		kv.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	case bool:
+		kv.Value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+// otlp returns the finished trace in OTLP JSON structure
+func (tr *Trace) otlp() otlpRequest {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	spans := make([]otlpSpan, 0, len(tr.spans)+1)
+	spans = append(spans, tr.otlpSpan(tr.root, ""))
+	for _, s := range tr.spans {
+		spans = append(spans, tr.otlpSpan(s, tr.root.id))
+	}
+	return otlpRequest{ResourceSpans: []resourceSpans{{
+		Resource:   resource{Attributes: []keyValue{newKeyValue("service.name", serviceName)}},
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: serviceName}, Spans: spans}},
+	}}}
+}
+
+func (tr *Trace) otlpSpan(s *span, parent string) otlpSpan {
+	return otlpSpan{
+		TraceID:           tr.id,
+		SpanID:            s.id,
+		ParentSpanID:      parent,
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+}
+
+// newID returns n random bytes hex encoded
+func newID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,96 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sKudryashov/stacksrv/pkg/logger"
+)
+
+func TestTrace(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewTracer(&buf, logger.App)
+	tr := tracer.Start(SpanRequest)
+	tr.SetAttr("conn_id", 7)
+	tr.Start(SpanReadBody)
+	tr.End(SpanReadBody)
+	tr.Start(SpanBlocked)
+	tr.Finish()
+	tr.Finish()
+	tr.Start(SpanWriteResponse)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d exported traces, want 1", len(lines))
+	}
+	var req otlpRequest
+	if err := json.Unmarshal([]byte(lines[0]), &req); err != nil {
+		t.Fatalf("trace isn't OTLP JSON: %v", err)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	tests := []struct {
+		name   string
+		kind   int
+		parent bool
+	}{
+		{SpanRequest, kindServer, false},
+		{SpanReadBody, kindInternal, true},
+		{SpanBlocked, kindInternal, true},
+	}
+	if len(spans) != len(tests) {
+		t.Fatalf("got %d spans, want %d", len(spans), len(tests))
+	}
+	root := spans[0]
+	for i, tt := range tests {
+		s := spans[i]
+		if s.Name != tt.name || s.Kind != tt.kind {
+			t.Errorf("span %d = %s kind %d, want %s kind %d", i, s.Name, s.Kind, tt.name, tt.kind)
+		}
+		if s.TraceID != root.TraceID || len(s.TraceID) != 32 || len(s.SpanID) != 16 {
+			t.Errorf("span %s ids = %s/%s", s.Name, s.TraceID, s.SpanID)
+		}
+		if tt.parent && s.ParentSpanID != root.SpanID {
+			t.Errorf("span %s parent = %q, want %q", s.Name, s.ParentSpanID, root.SpanID)
+		}
+		start, serr := strconv.ParseInt(s.StartTimeUnixNano, 10, 64)
+		end, eerr := strconv.ParseInt(s.EndTimeUnixNano, 10, 64)
+		if serr != nil || eerr != nil {
+			t.Fatalf("span %s times aren't nanoseconds: %s-%s", s.Name, s.StartTimeUnixNano, s.EndTimeUnixNano)
+		}
+		if start == 0 || end < start {
+			t.Errorf("span %s isn't ended: %s-%s", s.Name, s.StartTimeUnixNano, s.EndTimeUnixNano)
+		}
+	}
+	if a := root.Attributes; len(a) != 1 || a[0].Key != "conn_id" || *a[0].Value.IntValue != "7" {
+		t.Errorf("root attributes = %+v", a)
+	}
+
+	// a nil tracer traces nothing
+	var none *Tracer
+	none.Start(SpanRequest).Finish()
+}
+
+func TestTracer_Close(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tracer, err := Open(filepath.Join(dir, "trace.json"), logger.App)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := tracer.Close(); err != nil {
+			t.Fatalf("Close() #%d error = %v", i+1, err)
+		}
+	}
+	// traces finished after Close are dropped
+	tracer.Start(SpanRequest).Finish()
+}
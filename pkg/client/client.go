@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sKudryashov/stacksrv/pkg/frame"
+)
+
+// Response errors, match them with errors.Is
+var (
+	// ErrBusy is returned when the pool is full, it's retried if Retry is set
+	ErrBusy = &frame.ResponseError{Code: frame.RespBusy}
+	// ErrDenied is returned when the identity isn't allowed to run the operation
+	ErrDenied = &frame.ResponseError{Code: frame.RespDenied}
+	// ErrUnauthenticated is returned when the token is missing or wrong
+	ErrUnauthenticated = &frame.ResponseError{Code: frame.RespUnauthenticated}
+	// ErrRateLimited is returned when the client is throttled
+	ErrRateLimited = &frame.ResponseError{Code: frame.RespRateLimited}
+	// ErrShuttingDown is returned to a blocked request when the server stops
+	ErrShuttingDown = &frame.ResponseError{Code: frame.RespShuttingDown}
+)
+
+// Retry represents retries of requests answered with ErrBusy, zero Retry
+// doesn't retry. The n-th retry waits Backoff * 2^(n-1) but no more than
+// MaxBackoff if it's set
+type Retry struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Options represents client settings
+type Options struct {
+	// TLS enables TLS when it's set
+	TLS *tls.Config
+	// Token is sent in the auth frame when it's set
+	Token []byte
+	Retry Retry
+}
+
+// Client talks to a stack server, every request is a connection of its own
+// as the server closes it after the response. It's safe for concurrent use
+type Client struct {
+	addr   string
+	opts   Options
+	dialer net.Dialer
+}
+
+// New a Client constructor, addr is the service address. The TLS server
+// name is the addr host unless it's set
+func New(addr string, opts Options) *Client {
+	if opts.TLS != nil && opts.TLS.ServerName == "" {
+		opts.TLS = opts.TLS.Clone()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			opts.TLS.ServerName = host
+		}
+	}
+	return &Client{addr: addr, opts: opts}
+}
+
+// Push pushes payload of 1 to frame.MaxPayload bytes, it waits while the
+// stack is full
+func (c *Client) Push(ctx context.Context, payload []byte) error {
+	req, err := frame.EncodePush(payload)
+	if err != nil {
+		return err
+	}
+	_, err = c.retry(ctx, req, func(conn net.Conn) ([]byte, error) {
+		return nil, frame.ReadPushResponse(conn)
+	})
+	return err
+}
+
+// Pop pops the top item, it waits while the stack is empty
+func (c *Client) Pop(ctx context.Context) ([]byte, error) {
+	return c.retry(ctx, frame.EncodePop(), func(conn net.Conn) ([]byte, error) {
+		return frame.ReadPopResponse(conn)
+	})
+}
+
+// retry runs the request until it's not answered with busy or the attempts
+// are over
+func (c *Client) retry(ctx context.Context, req []byte, read func(net.Conn) ([]byte, error)) ([]byte, error) {
+	backoff := c.opts.Retry.Backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.do(ctx, req, read)
+		if !errors.Is(err, ErrBusy) || attempt >= c.opts.Retry.Attempts {
+			return resp, err
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+		backoff *= 2
+		if c.opts.Retry.MaxBackoff > 0 && backoff > c.opts.Retry.MaxBackoff {
+			backoff = c.opts.Retry.MaxBackoff
+		}
+	}
+}
+
+// do sends a single request over a new connection, ctx being done unblocks
+// every network call
+func (c *Client) do(ctx context.Context, req []byte, read func(net.Conn) ([]byte, error)) ([]byte, error) {
+	conn, err := c.dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %w", c.addr, err)
+	}
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// a deadline in the past fails pending reads and writes at once
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	resp, err := c.exchange(conn, req, read)
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return nil, ctxErr
+	}
+	return resp, err
+}
+
+func (c *Client) exchange(conn net.Conn, req []byte, read func(net.Conn) ([]byte, error)) ([]byte, error) {
+	if c.opts.TLS != nil {
+		tlsConn := tls.Client(conn, c.opts.TLS)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("tls handshake failed: %w", err)
+		}
+		conn = tlsConn
+	}
+	if c.opts.Token != nil {
+		auth, err := frame.EncodeAuth(c.opts.Token)
+		if err != nil {
+			return nil, err
+		}
+		req = append(auth, req...)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("unable to send request: %w", err)
+	}
+	return read(conn)
+}
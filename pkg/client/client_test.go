@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sKudryashov/stacksrv/pkg/config"
+	"github.com/sKudryashov/stacksrv/pkg/frame"
+	"github.com/sKudryashov/stacksrv/pkg/server"
+)
+
+func startServer(t *testing.T) *server.Server {
+	cfg := config.Defaults()
+	cfg.Service.Addr = "127.0.0.1:0"
+	cfg.Service.ControlAddr = "127.0.0.1:0"
+	cfg.Log.Level = "error"
+	srv, err := server.New(server.Options{Config: cfg})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	return srv
+}
+
+func TestPushPop(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Shutdown(context.Background())
+	c := New(srv.Addr().String(), Options{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.Push(ctx, []byte("abc")); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	got, err := c.Pop(ctx)
+	if err != nil || string(got) != "abc" {
+		t.Errorf("Pop() = %q, %v, want abc", got, err)
+	}
+	if err := c.Push(ctx, make([]byte, frame.MaxPayload+1)); err == nil {
+		t.Errorf("Push() of a too long payload succeeded")
+	}
+}
+
+func TestPopCancel(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Shutdown(context.Background())
+	c := New(srv.Addr().String(), Options{})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	// the stack is empty, so the pop blocks until the deadline
+	if _, err := c.Pop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Pop() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// busyServer answers the first busy requests with the busy response and the
+// rest with push success, it returns the listener address and a request
+// counter
+func busyServer(t *testing.T, busy int32) (string, *int32, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error = %v", err)
+	}
+	var requests int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			resp := frame.RespOK
+			if atomic.AddInt32(&requests, 1) <= busy {
+				resp = frame.RespBusy
+			}
+			conn.Write([]byte{resp})
+			conn.Close()
+		}
+	}()
+	return l.Addr().String(), &requests, func() { l.Close() }
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		busy         int32
+		retry        Retry
+		wantErr      error
+		wantRequests int32
+	}{
+		{"no retry", 1, Retry{}, ErrBusy, 1},
+		{"retried", 2, Retry{Attempts: 3, Backoff: time.Millisecond}, nil, 3},
+		{"attempts are over", 5, Retry{Attempts: 2, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}, ErrBusy, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, requests, stop := busyServer(t, tt.busy)
+			defer stop()
+			c := New(addr, Options{Retry: tt.retry})
+			err := c.Push(context.Background(), []byte("a"))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Push() error = %v, want %v", err, tt.wantErr)
+			}
+			if n := atomic.LoadInt32(requests); n != tt.wantRequests {
+				t.Errorf("server got %d requests, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
@@ -0,0 +1,495 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config represents the whole server configuration. It's built from defaults,
+// then a JSON file, then environment variables, then command line flags, each
+// later layer overriding the previous one
+type Config struct {
+	Service   Service   `json:"service"`
+	TLS       TLS       `json:"tls"`
+	Auth      Auth      `json:"auth"`
+	Pool      Pool      `json:"pool"`
+	Stack     Stack     `json:"stack"`
+	RateLimit RateLimit `json:"rate_limit"`
+	Reader    Reader    `json:"reader"`
+	Log       Log       `json:"log"`
+	Audit     Audit     `json:"audit"`
+	Trace     Trace     `json:"trace"`
+}
+
+// Service represents listening addresses and process lifecycle settings
+type Service struct {
+	Addr        string `json:"addr"`
+	ControlAddr string `json:"control_addr"`
+	// AdminAddr is the JSON admin API address, empty disables it
+	AdminAddr string `json:"admin_addr"`
+	// MetricsAddr is the Prometheus metrics address, empty disables it
+	MetricsAddr string `json:"metrics_addr"`
+	// PprofAddr is the pprof and trace handlers address, empty disables them
+	PprofAddr string `json:"pprof_addr"`
+	// ShutdownGrace is the time in-flight requests get to finish on SIGTERM
+	ShutdownGrace Duration `json:"shutdown_grace"`
+}
+
+// TLS represents service endpoint TLS, empty Cert and Key mean plain TCP
+type TLS struct {
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	ClientCA string `json:"client_ca"`
+}
+
+// Enabled returns whether the service endpoint speaks TLS
+func (t TLS) Enabled() bool {
+	return t.Cert != ""
+}
+
+// Auth represents client authentication and authorization files
+type Auth struct {
+	Policy string `json:"policy"`
+	Tokens string `json:"tokens"`
+}
+
+// Pool represents connection pool settings
+type Pool struct {
+	Size        int        `json:"size"`
+	Expiration  Duration   `json:"expiration"`
+	Eviction    string     `json:"eviction"`
+	IPLimit     int        `json:"ip_limit"`
+	CIDRLimits  CIDRLimits `json:"cidr_limits"`
+	ReservePush int        `json:"reserve_push"`
+	ReservePop  int        `json:"reserve_pop"`
+}
+
+// Stack represents stack settings
+type Stack struct {
+	Capacity int `json:"capacity"`
+}
+
+// RateLimit represents per client request rate limits, zero Rate disables them
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+	Code  string  `json:"code"`
+}
+
+// Reader represents request reading limits
+type Reader struct {
+	HeaderTimeout Duration `json:"header_timeout"`
+	MinRate       float64  `json:"min_rate"`
+}
+
+// Log represents logging settings
+type Log struct {
+	Level string `json:"level"`
+}
+
+// Audit represents the stack mutation audit log, empty Path disables it
+type Audit struct {
+	Path string `json:"path"`
+	// MaxSize is the file size in bytes the log is rotated at
+	MaxSize int64 `json:"max_size"`
+	// MaxFiles is the number of rotated files kept
+	MaxFiles int `json:"max_files"`
+}
+
+// Trace represents request tracing, Output is a file path or "stdout", empty
+// disables it
+type Trace struct {
+	Output string `json:"output"`
+}
+
+// Duration is a time.Duration which is read from JSON as a string like "10s"
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// CIDRLimits maps a network in CIDR notation to the max pool slots its clients
+// may hold together. As a flag it's a comma separated list of "cidr=limit"
+type CIDRLimits map[string]int
+
+// String implements flag.Value
+func (l *CIDRLimits) String() string {
+	if l == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*l))
+	for cidr, limit := range *l {
+		pairs = append(pairs, cidr+"="+strconv.Itoa(limit))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set implements flag.Value, it replaces all the limits
+func (l *CIDRLimits) Set(s string) error {
+	limits := CIDRLimits{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("malformed cidr limit %q, expected cidr=limit", pair)
+		}
+		limit, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return fmt.Errorf("malformed cidr limit %q: %v", pair, err)
+		}
+		limits[parts[0]] = limit
+	}
+	*l = limits
+	return nil
+}
+
+// Defaults returns the configuration the server runs with when nothing is set
+func Defaults() *Config {
+	return &Config{
+		Service: Service{
+			Addr:          ":8080",
+			ControlAddr:   ":8081",
+			ShutdownGrace: Duration{5 * time.Second},
+		},
+		Pool: Pool{
+			Size:       100,
+			Expiration: Duration{10 * time.Second},
+			Eviction:   "oldest",
+		},
+		Stack: Stack{
+			Capacity: 100,
+		},
+		RateLimit: RateLimit{
+			Burst: 10,
+			Code:  "ratelimit",
+		},
+		Reader: Reader{
+			HeaderTimeout: Duration{20 * time.Second},
+		},
+		Log: Log{
+			Level: "debug",
+		},
+		Audit: Audit{
+			MaxSize:  100 << 20,
+			MaxFiles: 10,
+		},
+	}
+}
+
+// envVars maps environment variables to the flags they set
+var envVars = []struct {
+	env  string
+	flag string
+}{
+	{"SERVD_ADDR", "service"},
+	{"SERVD_CONTROL_ADDR", "control"},
+	{"SERVD_ADMIN_ADDR", "admin"},
+	{"SERVD_METRICS_ADDR", "metrics"},
+	{"SERVD_PPROF_ADDR", "pprof"},
+	{"SERVD_SHUTDOWN_GRACE", "shutdown-grace"},
+	{"SERVD_TLS_CERT", "tls-cert"},
+	{"SERVD_TLS_KEY", "tls-key"},
+	{"SERVD_TLS_CLIENT_CA", "tls-client-ca"},
+	{"SERVD_AUTH_POLICY", "auth-policy"},
+	{"SERVD_AUTH_TOKENS", "auth-tokens"},
+	{"CONN_POOL_SIZE", "pool-size"},
+	{"SERVD_POOL_EXPIRATION", "pool-expiration"},
+	{"SERVD_EVICTION", "eviction"},
+	{"SERVD_IP_LIMIT", "ip-limit"},
+	{"SERVD_CIDR_LIMITS", "cidr-limits"},
+	{"SERVD_RESERVE_PUSH", "reserve-push"},
+	{"SERVD_RESERVE_POP", "reserve-pop"},
+	{"QUEUE_SIZE", "stack-capacity"},
+	{"SERVD_RATE", "rate"},
+	{"SERVD_BURST", "burst"},
+	{"SERVD_RATE_LIMIT_CODE", "rate-limit-code"},
+	{"SERVD_HEADER_TIMEOUT", "header-timeout"},
+	{"SERVD_MIN_RATE", "min-rate"},
+	{"LOG_LEVEL", "log-level"},
+	{"SERVD_AUDIT_LOG", "audit-log"},
+	{"SERVD_AUDIT_MAX_SIZE", "audit-max-size"},
+	{"SERVD_AUDIT_MAX_FILES", "audit-max-files"},
+	{"SERVD_TRACE", "trace"},
+}
+
+// Load builds the configuration from the file given by -config flag or
+// SERVD_CONFIG variable, environment variables and args, and validates it
+func Load(name string, args []string) (*Config, error) {
+	cfg := Defaults()
+	path := os.Getenv("SERVD_CONFIG")
+	if p, ok := configFlag(args); ok {
+		path = p
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.String("config", path, "JSON configuration file, SERVD_CONFIG")
+	cfg.bind(fs)
+	for _, v := range envVars {
+		val, ok := os.LookupEnv(v.env)
+		if !ok || val == "" {
+			continue
+		}
+		if err := fs.Set(v.flag, val); err != nil {
+			return nil, fmt.Errorf("invalid %s=%q: %v", v.env, val, err)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile overrides c with the values present in the JSON file, unknown keys
+// are an error so typos don't go unnoticed. Only .json files are read, other
+// formats such as YAML aren't supported
+func (c *Config) loadFile(path string) error {
+	if ext := filepath.Ext(path); !strings.EqualFold(ext, ".json") {
+		return fmt.Errorf("unable to load config file %s: only JSON files with the .json extension are supported", path)
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read config file %s: %v", path, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("unable to parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c *Config) bind(fs *flag.FlagSet) {
+	fs.StringVar(&c.Service.Addr, "service", c.Service.Addr, "service address endpoint, SERVD_ADDR")
+	fs.StringVar(&c.Service.ControlAddr, "control", c.Service.ControlAddr, "control address endpoint, SERVD_CONTROL_ADDR")
+	fs.StringVar(&c.Service.AdminAddr, "admin", c.Service.AdminAddr, "JSON admin API address endpoint, disabled when empty, SERVD_ADMIN_ADDR")
+	fs.StringVar(&c.Service.MetricsAddr, "metrics", c.Service.MetricsAddr, "Prometheus metrics address endpoint serving /metrics, disabled when empty, SERVD_METRICS_ADDR")
+	fs.StringVar(&c.Service.PprofAddr, "pprof", c.Service.PprofAddr, "pprof and trace address endpoint serving /debug/pprof/, disabled when empty, SERVD_PPROF_ADDR")
+	fs.DurationVar(&c.Service.ShutdownGrace.Duration, "shutdown-grace", c.Service.ShutdownGrace.Duration, "time in-flight requests get to finish on SIGINT or SIGTERM, SERVD_SHUTDOWN_GRACE")
+	fs.StringVar(&c.TLS.Cert, "tls-cert", c.TLS.Cert, "PEM certificate file, enables TLS on the service endpoint, SERVD_TLS_CERT")
+	fs.StringVar(&c.TLS.Key, "tls-key", c.TLS.Key, "PEM private key file for -tls-cert, SERVD_TLS_KEY")
+	fs.StringVar(&c.TLS.ClientCA, "tls-client-ca", c.TLS.ClientCA, "PEM CA bundle, requires clients to present a certificate signed by it, SERVD_TLS_CLIENT_CA")
+	fs.StringVar(&c.Auth.Policy, "auth-policy", c.Auth.Policy, "JSON file mapping client identities to allowed operations, SERVD_AUTH_POLICY")
+	fs.StringVar(&c.Auth.Tokens, "auth-tokens", c.Auth.Tokens, "token file, requires every connection to start with an auth frame, SERVD_AUTH_TOKENS")
+	fs.IntVar(&c.Pool.Size, "pool-size", c.Pool.Size, "max concurrent client connections, CONN_POOL_SIZE")
+	fs.DurationVar(&c.Pool.Expiration.Duration, "pool-expiration", c.Pool.Expiration.Duration, "age a connection is safe from eviction, SERVD_POOL_EXPIRATION")
+	fs.StringVar(&c.Pool.Eviction, "eviction", c.Pool.Eviction, "eviction policy for a full pool: oldest, idle, blocked, reading or never, SERVD_EVICTION")
+	fs.IntVar(&c.Pool.IPLimit, "ip-limit", c.Pool.IPLimit, "max concurrent pool slots per client IP, 0 means no limit, SERVD_IP_LIMIT")
+	fs.Var(&c.Pool.CIDRLimits, "cidr-limits", "max concurrent pool slots per network, e.g. 10.0.0.0/8=20,192.168.1.0/24=5, SERVD_CIDR_LIMITS")
+	fs.IntVar(&c.Pool.ReservePush, "reserve-push", c.Pool.ReservePush, "pool slots blocked pops can never take, SERVD_RESERVE_PUSH")
+	fs.IntVar(&c.Pool.ReservePop, "reserve-pop", c.Pool.ReservePop, "pool slots blocked pushes can never take, SERVD_RESERVE_POP")
+	fs.IntVar(&c.Stack.Capacity, "stack-capacity", c.Stack.Capacity, "max items on the stack, QUEUE_SIZE")
+	fs.Float64Var(&c.RateLimit.Rate, "rate", c.RateLimit.Rate, "requests per second allowed per client IP and identity, 0 means no limit, SERVD_RATE")
+	fs.IntVar(&c.RateLimit.Burst, "burst", c.RateLimit.Burst, "requests a client may send at once before -rate applies, SERVD_BURST")
+	fs.StringVar(&c.RateLimit.Code, "rate-limit-code", c.RateLimit.Code, "response to throttled clients: ratelimit (0xFC) or busy (0xFF), SERVD_RATE_LIMIT_CODE")
+	fs.DurationVar(&c.Reader.HeaderTimeout.Duration, "header-timeout", c.Reader.HeaderTimeout.Duration, "time a client has to send the request header, SERVD_HEADER_TIMEOUT")
+	fs.Float64Var(&c.Reader.MinRate, "min-rate", c.Reader.MinRate, "minimum payload rate in bytes per second, slower clients are closed, 0 disables, SERVD_MIN_RATE")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "log level: debug, info or error, LOG_LEVEL")
+	fs.StringVar(&c.Audit.Path, "audit-log", c.Audit.Path, "file every push, pop and clear is appended to, disabled when empty, SERVD_AUDIT_LOG")
+	fs.Int64Var(&c.Audit.MaxSize, "audit-max-size", c.Audit.MaxSize, "audit log size in bytes it's rotated at, SERVD_AUDIT_MAX_SIZE")
+	fs.IntVar(&c.Audit.MaxFiles, "audit-max-files", c.Audit.MaxFiles, "rotated audit log files kept, SERVD_AUDIT_MAX_FILES")
+	fs.StringVar(&c.Trace.Output, "trace", c.Trace.Output, "file or stdout request traces are written to as OTLP JSON, disabled when empty, SERVD_TRACE")
+}
+
+// configFlag looks the config file path up in args before they are parsed,
+// the file has to be read before flags override its values
+func configFlag(args []string) (string, bool) {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if strings.HasPrefix(name, "config=") {
+			return strings.TrimPrefix(name, "config="), true
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+// Validate checks the whole configuration and reports every problem found
+func (c *Config) Validate() error {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if c.Service.Addr == "" {
+		addf("service address must be set")
+	}
+	if c.Service.ControlAddr == "" {
+		addf("control address must be set")
+	}
+	if c.Service.ShutdownGrace.Duration < 0 {
+		addf("shutdown grace must not be negative, got %s", c.Service.ShutdownGrace)
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		addf("tls cert and key must be set together")
+	}
+	if c.TLS.ClientCA != "" && c.TLS.Cert == "" {
+		addf("tls client CA requires tls cert and key")
+	}
+	if c.Pool.Size < 1 {
+		addf("pool size must be positive, got %d", c.Pool.Size)
+	}
+	if c.Pool.Expiration.Duration < 0 {
+		addf("pool expiration must not be negative, got %s", c.Pool.Expiration)
+	}
+	switch c.Pool.Eviction {
+	case "oldest", "idle", "blocked", "reading", "never":
+	default:
+		addf("unknown eviction policy %q, expected one of oldest, idle, blocked, reading, never", c.Pool.Eviction)
+	}
+	if c.Pool.IPLimit < 0 {
+		addf("ip limit must not be negative, got %d", c.Pool.IPLimit)
+	}
+	for cidr, limit := range c.Pool.CIDRLimits {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			addf("invalid cidr limit network %q", cidr)
+		}
+		if limit < 1 {
+			addf("cidr limit for %s must be positive, got %d", cidr, limit)
+		}
+	}
+	if c.Pool.Size >= 1 && (c.Pool.ReservePush < 0 || c.Pool.ReservePush >= c.Pool.Size) {
+		addf("reserved push slots must be between 0 and %d, got %d", c.Pool.Size-1, c.Pool.ReservePush)
+	}
+	if c.Pool.Size >= 1 && (c.Pool.ReservePop < 0 || c.Pool.ReservePop >= c.Pool.Size) {
+		addf("reserved pop slots must be between 0 and %d, got %d", c.Pool.Size-1, c.Pool.ReservePop)
+	}
+	if c.Stack.Capacity < 1 {
+		addf("stack capacity must be positive, got %d", c.Stack.Capacity)
+	}
+	if c.RateLimit.Rate < 0 {
+		addf("rate must not be negative, got %g", c.RateLimit.Rate)
+	}
+	if c.RateLimit.Burst < 1 {
+		addf("burst must be positive, got %d", c.RateLimit.Burst)
+	}
+	if c.RateLimit.Code != "ratelimit" && c.RateLimit.Code != "busy" {
+		addf("unknown rate limit code %q, expected ratelimit or busy", c.RateLimit.Code)
+	}
+	if c.Reader.HeaderTimeout.Duration <= 0 {
+		addf("header timeout must be positive, got %s", c.Reader.HeaderTimeout)
+	}
+	if c.Reader.MinRate < 0 {
+		addf("min rate must not be negative, got %g", c.Reader.MinRate)
+	}
+	switch c.Log.Level {
+	case "debug", "info", "error":
+	default:
+		addf("unknown log level %q, expected debug, info or error", c.Log.Level)
+	}
+	if c.Audit.MaxSize < 1 {
+		addf("audit log max size must be positive, got %d", c.Audit.MaxSize)
+	}
+	if c.Audit.MaxFiles < 0 {
+		addf("audit log max files must not be negative, got %d", c.Audit.MaxFiles)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// liveKeys are the settings a running server applies without a restart
+var liveKeys = map[string]bool{
+	"log.level":        true,
+	"pool.size":        true,
+	"pool.expiration":  true,
+	"pool.eviction":    true,
+	"rate_limit.rate":  true,
+	"rate_limit.burst": true,
+	"stack.capacity":   true,
+}
+
+// Diff compares two configurations and splits the keys that differ into the
+// ones a running server applies live and the ones which require a restart.
+// Keys are named as in the config file, e.g. "pool.size"
+func Diff(old, updated *Config) (live, restart []string) {
+	oldKeys, updatedKeys := flatten(old), flatten(updated)
+	for key, val := range updatedKeys {
+		if reflect.DeepEqual(oldKeys[key], val) {
+			continue
+		}
+		if liveKeys[key] {
+			live = append(live, key)
+		} else {
+			restart = append(restart, key)
+		}
+	}
+	sort.Strings(live)
+	sort.Strings(restart)
+	return live, restart
+}
+
+// WithLive returns a copy of c with the live settings taken from updated,
+// everything else keeps its current value until restart
+func (c *Config) WithLive(updated *Config) *Config {
+	applied := *c
+	applied.Log.Level = updated.Log.Level
+	applied.Pool.Size = updated.Pool.Size
+	applied.Pool.Expiration = updated.Pool.Expiration
+	applied.Pool.Eviction = updated.Pool.Eviction
+	applied.RateLimit.Rate = updated.RateLimit.Rate
+	applied.RateLimit.Burst = updated.RateLimit.Burst
+	applied.Stack.Capacity = updated.Stack.Capacity
+	return &applied
+}
+
+// flatten turns the config into "section.key" => value pairs
+func flatten(c *Config) map[string]interface{} {
+	raw, _ := json.Marshal(c)
+	sections := map[string]map[string]interface{}{}
+	json.Unmarshal(raw, &sections)
+	keys := make(map[string]interface{})
+	for section, fields := range sections {
+		for field, val := range fields {
+			keys[section+"."+field] = val
+		}
+	}
+	return keys
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad_Precedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "servd.json")
+	content := `{"pool": {"size": 50, "eviction": "idle", "expiration": "30s"}, "stack": {"capacity": 20}, "log": {"level": "info"}}`
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("QUEUE_SIZE", "30")
+	os.Setenv("CONN_POOL_SIZE", "60")
+	defer os.Unsetenv("QUEUE_SIZE")
+	defer os.Unsetenv("CONN_POOL_SIZE")
+
+	cfg, err := Load("servd", []string{"-config", path, "-pool-size", "70", "-cidr-limits", "10.0.0.0/8=5"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	tests := []struct {
+		name     string
+		got      interface{}
+		expected interface{}
+	}{
+		{name: "default", got: cfg.Service.Addr, expected: ":8080"},
+		{name: "file", got: cfg.Pool.Eviction, expected: "idle"},
+		{name: "file duration", got: cfg.Pool.Expiration.Duration, expected: 30 * time.Second},
+		{name: "env over file", got: cfg.Stack.Capacity, expected: 30},
+		{name: "flag over env", got: cfg.Pool.Size, expected: 70},
+		{name: "flag value", got: cfg.Pool.CIDRLimits["10.0.0.0/8"], expected: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.expected {
+				t.Fatalf("got %v, expected %v", tt.got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLoad_Validation(t *testing.T) {
+	_, err := Load("servd", []string{"-pool-size", "0", "-eviction", "random", "-log-level", "trace"})
+	if err == nil {
+		t.Fatalf("expected validation error")
+	}
+	for _, problem := range []string{"pool size", "eviction policy", "log level"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("error %q doesn't report %s", err, problem)
+		}
+	}
+	os.Setenv("CONN_POOL_SIZE", "many")
+	defer os.Unsetenv("CONN_POOL_SIZE")
+	if _, err := Load("servd", nil); err == nil || !strings.Contains(err.Error(), "CONN_POOL_SIZE") {
+		t.Fatalf("expected readable env error, got %v", err)
+	}
+}
+
+func TestLoad_FileFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		wantErr string
+	}{
+		{name: "json", file: "servd.json", content: `{"stack": {"capacity": 20}}`},
+		{name: "upper case extension", file: "servd.JSON", content: `{"stack": {"capacity": 20}}`},
+		{name: "yaml", file: "servd.yaml", content: "stack:\n  capacity: 20\n", wantErr: "only JSON"},
+		{name: "no extension", file: "servd", content: `{"stack": {"capacity": 20}}`, wantErr: "only JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.file)
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := Load("servd", []string{"-config", path})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, expected %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if cfg.Stack.Capacity != 20 {
+				t.Fatalf("got capacity %d, expected 20", cfg.Stack.Capacity)
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := Defaults()
+	updated := Defaults()
+	updated.Pool.Size = 200
+	updated.Log.Level = "error"
+	updated.Service.Addr = ":9090"
+	updated.Pool.CIDRLimits = CIDRLimits{"10.0.0.0/8": 5}
+
+	live, restart := Diff(old, updated)
+	if strings.Join(live, ",") != "log.level,pool.size" {
+		t.Fatalf("unexpected live keys %v", live)
+	}
+	if strings.Join(restart, ",") != "pool.cidr_limits,service.addr" {
+		t.Fatalf("unexpected restart keys %v", restart)
+	}
+	applied := old.WithLive(updated)
+	if applied.Pool.Size != 200 || applied.Service.Addr != ":8080" {
+		t.Fatalf("WithLive applied %+v", applied)
+	}
+}
@@ -0,0 +1,150 @@
+package frame
+
+import (
+	"fmt"
+	"io"
+)
+
+// Ops carried by the high bit of a request header
+const (
+	OpPush byte = 0
+	OpPop  byte = 1
+)
+
+// MaxPayload is the longest payload a request header can announce
+const MaxPayload = 127
+
+// Response codes, a pop response starts with the payload length instead of
+// RespOK, which never exceeds MaxPayload
+const (
+	// RespOK is a successful push response
+	RespOK byte = 0x00
+	// RespBusy is a busy-state response
+	RespBusy byte = 0xFF
+	// RespDenied is sent when the client identity isn't allowed to run the action
+	RespDenied byte = 0xFE
+	// RespUnauthenticated is sent when the auth frame is missing or the token is wrong
+	RespUnauthenticated byte = 0xFD
+	// RespRateLimited is sent to throttled clients unless they are configured to get RespBusy
+	RespRateLimited byte = 0xFC
+	// RespShuttingDown is sent to blocked requests when the server shuts down
+	RespShuttingDown byte = 0xFB
+)
+
+// ResponseError is a response code other than success. errors.Is matches
+// response errors with the same code
+type ResponseError struct {
+	Code byte
+}
+
+func (e *ResponseError) Error() string {
+	switch e.Code {
+	case RespBusy:
+		return "server is busy"
+	case RespDenied:
+		return "permission denied"
+	case RespUnauthenticated:
+		return "authentication failed"
+	case RespRateLimited:
+		return "rate limited"
+	case RespShuttingDown:
+		return "server is shutting down"
+	default:
+		return fmt.Sprintf("unknown response code %#x", e.Code)
+	}
+}
+
+// Is reports whether target is a response error with the same code
+func (e *ResponseError) Is(target error) bool {
+	t, ok := target.(*ResponseError)
+	return ok && t.Code == e.Code
+}
+
+// EncodeHeader returns the request header of op with an n byte payload
+func EncodeHeader(op byte, n int) (byte, error) {
+	if op != OpPush && op != OpPop {
+		return 0, fmt.Errorf("unknown op %d", op)
+	}
+	if n < 0 || n > MaxPayload {
+		return 0, fmt.Errorf("payload length must be between 0 and %d, got %d", MaxPayload, n)
+	}
+	return op<<7 | byte(n), nil
+}
+
+// DecodeHeader returns the op and the payload length of a request header
+func DecodeHeader(header byte) (byte, int) {
+	return header >> 7, int(header & MaxPayload)
+}
+
+// EncodePush returns a push request of payload
+func EncodePush(payload []byte) ([]byte, error) {
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("push payload can't be empty")
+	}
+	header, err := EncodeHeader(OpPush, len(payload))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{header}, payload...), nil
+}
+
+// EncodePop returns a pop request
+func EncodePop() []byte {
+	header, _ := EncodeHeader(OpPop, 0)
+	return []byte{header}
+}
+
+// EncodeAuth returns the auth frame carrying token, it precedes the request
+// when the server requires tokens
+func EncodeAuth(token []byte) ([]byte, error) {
+	if len(token) == 0 || len(token) > MaxPayload {
+		return nil, fmt.Errorf("token length must be between 1 and %d, got %d", MaxPayload, len(token))
+	}
+	return append([]byte{byte(len(token))}, token...), nil
+}
+
+// EncodePopResponse returns the pop response carrying data
+func EncodePopResponse(data []byte) []byte {
+	response := make([]byte, 0, len(data)+1)
+	response = append(response, byte(len(data)))
+	return append(response, data...)
+}
+
+// ReadPushResponse reads a push response, a code other than RespOK is a
+// *ResponseError
+func ReadPushResponse(r io.Reader) error {
+	var code [1]byte
+	if _, err := io.ReadFull(r, code[:]); err != nil {
+		return fmt.Errorf("unable to read push response: %w", unexpected(err))
+	}
+	if code[0] != RespOK {
+		return &ResponseError{Code: code[0]}
+	}
+	return nil
+}
+
+// ReadPopResponse reads a pop response and returns its payload, a response
+// code is a *ResponseError
+func ReadPopResponse(r io.Reader) ([]byte, error) {
+	var ln [1]byte
+	if _, err := io.ReadFull(r, ln[:]); err != nil {
+		return nil, fmt.Errorf("unable to read pop response: %w", unexpected(err))
+	}
+	if ln[0] > MaxPayload {
+		return nil, &ResponseError{Code: ln[0]}
+	}
+	data := make([]byte, ln[0])
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("unable to read pop payload: %w", unexpected(err))
+	}
+	return data, nil
+}
+
+// unexpected turns EOF into io.ErrUnexpectedEOF, the server closes the
+// connection without a response when the request fails
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package frame
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestHeader(t *testing.T) {
+	tests := []struct {
+		op      byte
+		n       int
+		want    byte
+		wantErr bool
+	}{
+		{OpPush, 8, 0x08, false},
+		{OpPush, MaxPayload, 0x7F, false},
+		{OpPop, 0, 0x80, false},
+		{OpPush, MaxPayload + 1, 0, true},
+		{2, 1, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := EncodeHeader(tt.op, tt.n)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("EncodeHeader(%d, %d) error = %v, wantErr %v", tt.op, tt.n, err, tt.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("EncodeHeader(%d, %d) = %#x, want %#x", tt.op, tt.n, got, tt.want)
+		}
+		if op, n := DecodeHeader(got); op != tt.op || n != tt.n {
+			t.Errorf("DecodeHeader(%#x) = %d, %d, want %d, %d", got, op, n, tt.op, tt.n)
+		}
+	}
+}
+
+func TestReadResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		pop      bool
+		resp     []byte
+		wantData string
+		wantErr  error
+	}{
+		{"push ok", false, []byte{RespOK}, "", nil},
+		{"push busy", false, []byte{RespBusy}, "", &ResponseError{Code: RespBusy}},
+		{"push closed", false, nil, "", io.ErrUnexpectedEOF},
+		{"pop", true, EncodePopResponse([]byte("abc")), "abc", nil},
+		{"pop shutting down", true, []byte{RespShuttingDown}, "", &ResponseError{Code: RespShuttingDown}},
+		{"pop cut", true, []byte{3, 'a'}, "", io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data []byte
+			var err error
+			if tt.pop {
+				data, err = ReadPopResponse(bytes.NewReader(tt.resp))
+			} else {
+				err = ReadPushResponse(bytes.NewReader(tt.resp))
+			}
+			if tt.wantErr == nil && err != nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if string(data) != tt.wantData {
+				t.Errorf("data = %q, want %q", data, tt.wantData)
+			}
+		})
+	}
+}
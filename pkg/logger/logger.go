@@ -1,37 +1,168 @@
 package logger
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
-	"github.com/labstack/gommon/log"
+// Levels in increasing order of severity
+const (
+	LevelDebug int32 = iota
+	LevelInfo
+	LevelError
 )
 
+var levelNames = map[int32]string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelError: "ERROR",
+}
+
+// Logger is what server components log with, With returns a logger adding
+// a field to every line, e.g. the connection ID
+type Logger interface {
+	Debug(args ...interface{})
+	Debugf(format string, args ...interface{})
+	Info(args ...interface{})
+	Infof(format string, args ...interface{})
+	Error(args ...interface{})
+	Errorf(format string, args ...interface{})
+	With(key string, value interface{}) Logger
+}
+
 // App application logger
-var App *log.Logger
+var App *JSON
 
 // Control channel logger
-var Control *log.Logger
+var Control *JSON
 
 func init() {
-	lgr := log.New("server")
-	lgr.SetHeader(`"level":"${level}","time":"${time_rfc3339_nano}","name":"${prefix}","location":"${short_file}:${line}"}`)
-	lgr.SetLevel(getLogLVL())
-	App = lgr
+	App = New("server", os.Stdout)
+	Control = New("control", os.Stdout)
+}
 
-	lgr = log.New("control")
-	lgr.SetHeader(`"level":"${level}","name":"${prefix}","location":"${short_file}:${line}"}`)
-	lgr.SetLevel(getLogLVL())
-	Control = lgr
+// SetLevel sets the level of every logger, unknown level means debug
+func SetLevel(lvl string) {
+	App.SetLevel(lvl)
+	Control.SetLevel(lvl)
 }
 
-func getLogLVL() log.Lvl {
-	lvl := os.Getenv("LOG_LEVEL")
+func parseLVL(lvl string) int32 {
 	switch lvl {
 	case "info":
-		return log.INFO
+		return LevelInfo
 	case "error":
-		return log.ERROR
+		return LevelError
 	default:
-		return log.DEBUG
+		return LevelDebug
 	}
 }
+
+// output is shared by a logger and the loggers derived from it by With
+type output struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level int32
+}
+
+// JSON writes a JSON object per line: level, time, logger name, location,
+// fields and message
+type JSON struct {
+	name   string
+	out    *output
+	fields []byte
+}
+
+// New a JSON logger constructor, the level is debug until it's set
+func New(name string, w io.Writer) *JSON {
+	return &JSON{
+		name: name,
+		out:  &output{w: w, level: LevelDebug},
+	}
+}
+
+// SetLevel sets the level of the logger and the loggers derived from it,
+// unknown level means debug
+func (l *JSON) SetLevel(lvl string) {
+	atomic.StoreInt32(&l.out.level, parseLVL(lvl))
+}
+
+// With returns a logger adding key to every line
+func (l *JSON) With(key string, value interface{}) Logger {
+	fields := make([]byte, len(l.fields), len(l.fields)+len(key)+16)
+	copy(fields, l.fields)
+	fields = append(fields, ',')
+	fields = appendString(fields, key)
+	fields = append(fields, ':')
+	raw, err := json.Marshal(value)
+	if err != nil {
+		raw, _ = json.Marshal(fmt.Sprint(value))
+	}
+	fields = append(fields, raw...)
+	return &JSON{name: l.name, out: l.out, fields: fields}
+}
+
+// Debug logs at debug level
+func (l *JSON) Debug(args ...interface{}) { l.log(LevelDebug, fmt.Sprint(args...)) }
+
+// Debugf logs at debug level
+func (l *JSON) Debugf(format string, args ...interface{}) {
+	l.log(LevelDebug, fmt.Sprintf(format, args...))
+}
+
+// Info logs at info level
+func (l *JSON) Info(args ...interface{}) { l.log(LevelInfo, fmt.Sprint(args...)) }
+
+// Infof logs at info level
+func (l *JSON) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, fmt.Sprintf(format, args...))
+}
+
+// Error logs at error level
+func (l *JSON) Error(args ...interface{}) { l.log(LevelError, fmt.Sprint(args...)) }
+
+// Errorf logs at error level
+func (l *JSON) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, fmt.Sprintf(format, args...))
+}
+
+func (l *JSON) log(lvl int32, msg string) {
+	if lvl < atomic.LoadInt32(&l.out.level) {
+		return
+	}
+	location := "???:0"
+	// 0 is log, 1 is the level method and 2 is its caller
+	if _, file, line, ok := runtime.Caller(2); ok {
+		location = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	b := make([]byte, 0, 256)
+	b = append(b, `{"level":"`...)
+	b = append(b, levelNames[lvl]...)
+	b = append(b, `","time":"`...)
+	b = time.Now().UTC().AppendFormat(b, time.RFC3339Nano)
+	b = append(b, `","name":`...)
+	b = appendString(b, l.name)
+	b = append(b, `,"location":`...)
+	b = appendString(b, location)
+	b = append(b, l.fields...)
+	b = append(b, `,"message":`...)
+	b = appendString(b, msg)
+	b = append(b, "}\n"...)
+	l.out.mu.Lock()
+	l.out.w.Write(b)
+	l.out.mu.Unlock()
+}
+
+// appendString appends s as a JSON string
+func appendString(b []byte, s string) []byte {
+	raw, _ := json.Marshal(s)
+	return append(b, raw...)
+}
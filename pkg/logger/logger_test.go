@@ -0,0 +1,55 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := New("test", &buf)
+	l.SetLevel("info")
+	l.Debug("dropped")
+	l.With("conn_id", 7).With("remote", "127.0.0.1:1").Infof("accepted %q", "x")
+	l.Error("failed")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %q", len(lines), lines)
+	}
+	tests := []struct {
+		line   string
+		fields map[string]interface{}
+	}{
+		{lines[0], map[string]interface{}{
+			"level":   "INFO",
+			"name":    "test",
+			"conn_id": float64(7),
+			"remote":  "127.0.0.1:1",
+			"message": `accepted "x"`,
+		}},
+		{lines[1], map[string]interface{}{
+			"level":   "ERROR",
+			"message": "failed",
+		}},
+	}
+	for _, tt := range tests {
+		var got map[string]interface{}
+		if err := json.Unmarshal([]byte(tt.line), &got); err != nil {
+			t.Fatalf("line %q isn't JSON: %v", tt.line, err)
+		}
+		for k, want := range tt.fields {
+			if got[k] != want {
+				t.Errorf("%s = %v, want %v", k, got[k], want)
+			}
+		}
+		if loc, _ := got["location"].(string); !strings.HasPrefix(loc, "logger_test.go:") {
+			t.Errorf("location = %q, want logger_test.go:<line>", loc)
+		}
+	}
+	if strings.Contains(lines[1], "conn_id") {
+		t.Errorf("With fields leaked to the parent logger: %s", lines[1])
+	}
+}
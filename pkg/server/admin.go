@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sKudryashov/stacksrv/internal/service/formatter"
+	"github.com/sKudryashov/stacksrv/pkg/config"
+)
+
+// stackState is the GET /api/stack reply, items are base64 encoded from the top
+type stackState struct {
+	Len   int      `json:"len"`
+	Cap   int      `json:"cap"`
+	Items [][]byte `json:"items"`
+}
+
+// poolState is the GET /api/pool reply
+type poolState struct {
+	Len   int        `json:"len"`
+	Cap   int        `json:"cap"`
+	Conns []connJSON `json:"conns"`
+}
+
+type connJSON struct {
+	ID         int    `json:"id"`
+	Remote     string `json:"remote"`
+	State      string `json:"state"`
+	Action     string `json:"action"`
+	AgeSeconds int64  `json:"age_seconds"`
+	BytesRead  int64  `json:"bytes_read"`
+}
+
+// waitersState is the GET /api/waiters reply
+type waitersState struct {
+	Pops   int `json:"pops"`
+	Pushes int `json:"pushes"`
+}
+
+// adminHandler returns the JSON admin API, every reply is read from the live
+// pool and queue
+func (srv *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/stack", srv.adminMethod(http.MethodGet, func(r *http.Request) (interface{}, int, error) {
+		q := srv.handler().Queue()
+		items := q.Snapshot()
+		top := make([][]byte, 0, len(items))
+		for i := len(items) - 1; i >= 0; i-- {
+			top = append(top, items[i])
+		}
+		return stackState{Len: len(items), Cap: q.Cap(), Items: top}, http.StatusOK, nil
+	}))
+	mux.HandleFunc("/api/pool", srv.adminMethod(http.MethodGet, func(r *http.Request) (interface{}, int, error) {
+		pool := srv.pool()
+		st := poolState{Cap: pool.MaxConn(), Conns: []connJSON{}}
+		for _, c := range pool.Conns() {
+			st.Conns = append(st.Conns, connJSON{
+				ID:         c.ID,
+				Remote:     c.Remote,
+				State:      c.State.String(),
+				Action:     formatter.ActionName(c.Action),
+				AgeSeconds: int64(c.Age / time.Second),
+				BytesRead:  c.BytesRead,
+			})
+		}
+		st.Len = len(st.Conns)
+		return st, http.StatusOK, nil
+	}))
+	mux.HandleFunc("/api/waiters", srv.adminMethod(http.MethodGet, func(r *http.Request) (interface{}, int, error) {
+		pops, pushes := srv.handler().Queue().Waiters()
+		return waitersState{Pops: pops, Pushes: pushes}, http.StatusOK, nil
+	}))
+	mux.HandleFunc("/api/reset", srv.adminMethod(http.MethodPost, func(r *http.Request) (interface{}, int, error) {
+		items, conns := srv.handler().Reset()
+		return map[string]int{"items_dropped": items, "conns_closed": conns}, http.StatusOK, nil
+	}))
+	mux.HandleFunc("/api/resize", srv.adminMethod(http.MethodPost, func(r *http.Request) (interface{}, int, error) {
+		req := struct {
+			Capacity int `json:"capacity"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("malformed request: %v", err)
+		}
+		if err := srv.updateLive(func(cfg *config.Config) { cfg.Stack.Capacity = req.Capacity }); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		return req, http.StatusOK, nil
+	}))
+	mux.HandleFunc("/api/kick", srv.adminMethod(http.MethodPost, func(r *http.Request) (interface{}, int, error) {
+		req := struct {
+			ID int `json:"id"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("malformed request: %v", err)
+		}
+		if !srv.pool().Kick(req.ID) {
+			return nil, http.StatusNotFound, fmt.Errorf("no connection %d", req.ID)
+		}
+		return req, http.StatusOK, nil
+	}))
+	mux.HandleFunc("/api/drain", srv.adminMethod(http.MethodPost, func(r *http.Request) (interface{}, int, error) {
+		// the server keeps running, so clients get busy to retry rather than
+		// shutting down
+		n := srv.handler().BounceWaiters()
+		return map[string]int{"drained": n}, http.StatusOK, nil
+	}))
+	return mux
+}
+
+// adminMethod wraps an admin endpoint, it checks the method and writes the
+// reply or the error as JSON
+func (srv *Server) adminMethod(method string, f func(r *http.Request) (interface{}, int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		var reply interface{}
+		code := http.StatusMethodNotAllowed
+		err := fmt.Errorf("method %s is not allowed, use %s", r.Method, method)
+		if r.Method == method {
+			reply, code, err = f(r)
+		}
+		if err != nil {
+			reply = map[string]string{"error": err.Error()}
+		}
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(reply); err != nil {
+			srv.ctlLog.Errorf("unable to write admin reply: %v", err)
+		}
+	}
+}
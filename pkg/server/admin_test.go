@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminAPI(t *testing.T) {
+	srv := startTestServer(t, Options{Restore: [][]byte{[]byte("a"), []byte("b")}})
+	defer srv.Shutdown(context.Background())
+	h := srv.adminHandler()
+
+	tests := []struct {
+		method   string
+		path     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{http.MethodGet, "/api/stack", "", http.StatusOK, `{"len":2,"cap":100,"items":["Yg==","YQ=="]}`},
+		{http.MethodGet, "/api/waiters", "", http.StatusOK, `{"pops":0,"pushes":0}`},
+		{http.MethodGet, "/api/pool", "", http.StatusOK, `{"len":0,"cap":100,"conns":[]}`},
+		{http.MethodPost, "/api/stack", "", http.StatusMethodNotAllowed, `{"error":"method POST is not allowed, use GET"}`},
+		{http.MethodPost, "/api/resize", `{"capacity":5}`, http.StatusOK, `{"capacity":5}`},
+		{http.MethodPost, "/api/resize", `{"capacity":-1}`, http.StatusBadRequest, `{"error":"invalid configuration:\n  stack capacity must be positive, got -1"}`},
+		{http.MethodPost, "/api/resize", `{`, http.StatusBadRequest, `{"error":"malformed request: unexpected EOF"}`},
+		{http.MethodPost, "/api/kick", `{"id":7}`, http.StatusNotFound, `{"error":"no connection 7"}`},
+		{http.MethodPost, "/api/drain", "", http.StatusOK, `{"drained":0}`},
+		{http.MethodPost, "/api/reset", "", http.StatusOK, `{"conns_closed":0,"items_dropped":2}`},
+		{http.MethodGet, "/api/stack", "", http.StatusOK, `{"len":0,"cap":5,"items":[]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if rec.Code != tt.wantCode {
+				t.Errorf("code = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); got != tt.wantBody {
+				t.Errorf("body = %s, want %s", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	srv := startTestServer(t, Options{})
+	defer srv.Shutdown(context.Background())
+	c, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error = %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte{0x80}); err != nil {
+		t.Fatalf("write error = %v", err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if pops, _ := srv.handler().Queue().Waiters(); pops == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pop on an empty stack isn't blocked")
+		}
+	}
+	rec := httptest.NewRecorder()
+	srv.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/drain", nil))
+	if got := strings.TrimSpace(rec.Body.String()); rec.Code != http.StatusOK || got != `{"drained":1}` {
+		t.Errorf("drain = %d %s, want 200 {\"drained\":1}", rec.Code, got)
+	}
+	// the server keeps running, so the client is told to retry
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if resp, err := ioutil.ReadAll(c); err != nil || !bytes.Equal(resp, []byte{0xFF}) {
+		t.Errorf("drained pop got %#v, %v, want busy", resp, err)
+	}
+	if n := srv.pool().Len(); n != 0 {
+		t.Errorf("%d connections left in the pool after drain", n)
+	}
+}
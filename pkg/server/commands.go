@@ -0,0 +1,280 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sKudryashov/stacksrv/internal/service/formatter"
+	"github.com/sKudryashov/stacksrv/internal/tap"
+	"github.com/sKudryashov/stacksrv/pkg/config"
+	"github.com/sKudryashov/stacksrv/pkg/logger"
+)
+
+// lineCmd is a line protocol command, run gets the command arguments and
+// returns the reply body. Commands which change the session set next
+// instead, their reply is "OK 0". Negative nargs means any number of
+// arguments
+type lineCmd struct {
+	usage string
+	help  string
+	nargs int
+	run   func(args []string) ([]string, error)
+	next  func(args []string) (lineNext, error)
+}
+
+// lineNext is what the control session does after the reply, the zero one
+// reads the next command
+type lineNext struct {
+	// quit closes the session
+	quit bool
+	// tap turns the session into a stream of the events filter matches
+	tap    bool
+	filter tap.Filter
+}
+
+// runLine runs a single command line and writes the reply: a status line
+// "OK <n>" followed by n body lines or a single "ERR <message>" line. It
+// returns what the session does next
+func runLine(w io.Writer, log logger.Logger, cmds map[string]lineCmd, line string) lineNext {
+	fields := strings.Fields(line)
+	name := strings.ToUpper(fields[0])
+	cmd, ok := cmds[name]
+	var body []string
+	var next lineNext
+	var err error
+	switch {
+	case !ok:
+		err = fmt.Errorf("unknown command %s, try HELP", fields[0])
+	case cmd.nargs >= 0 && len(fields)-1 != cmd.nargs:
+		err = fmt.Errorf("usage: %s", cmd.usage)
+	case cmd.next != nil:
+		log.Infof("control command %s", strings.Join(fields, " "))
+		next, err = cmd.next(fields[1:])
+	default:
+		log.Infof("control command %s", strings.Join(fields, " "))
+		body, err = cmd.run(fields[1:])
+	}
+	if err != nil {
+		// the status line is a single line whatever the error is
+		fmt.Fprintf(w, "ERR %s\n", strings.Join(strings.Fields(err.Error()), " "))
+		return lineNext{}
+	}
+	fmt.Fprintf(w, "OK %d\n", len(body))
+	for _, l := range body {
+		fmt.Fprintln(w, l)
+	}
+	return next
+}
+
+func (srv *Server) lineCmds() map[string]lineCmd {
+	cmds := map[string]lineCmd{
+		"STATS": {
+			usage: "STATS",
+			help:  "stack, pool and reader counters",
+			run: func([]string) ([]string, error) {
+				q, pool, st := srv.handler().Queue(), srv.pool(), srv.handler().Stats()
+				pops, pushes := q.Waiters()
+				return []string{
+					fmt.Sprintf("stack_len %d", q.Len()),
+					fmt.Sprintf("stack_cap %d", q.Cap()),
+					fmt.Sprintf("waiting_pops %d", pops),
+					fmt.Sprintf("waiting_pushes %d", pushes),
+					fmt.Sprintf("pool_len %d", pool.Len()),
+					fmt.Sprintf("pool_cap %d", pool.MaxConn()),
+					fmt.Sprintf("slow_headers %d", st.SlowHeaders),
+					fmt.Sprintf("slow_bodies %d", st.SlowBodies),
+					fmt.Sprintf("eofs %d", st.EOFs),
+				}, nil
+			},
+		},
+		"DUMP": {
+			usage: "DUMP",
+			help:  "stack items from the top, quoted",
+			run: func([]string) ([]string, error) {
+				items, err := srv.Snapshot()
+				if err != nil {
+					return nil, err
+				}
+				body := make([]string, 0, len(items))
+				for i := len(items) - 1; i >= 0; i-- {
+					body = append(body, strconv.Quote(string(items[i])))
+				}
+				return body, nil
+			},
+		},
+		"CONNS": {
+			usage: "CONNS",
+			help:  "pooled connections: id, remote address, state, action, age and bytes read",
+			run: func([]string) ([]string, error) {
+				conns := srv.pool().Conns()
+				body := make([]string, 0, len(conns))
+				for _, c := range conns {
+					body = append(body, fmt.Sprintf("%d %s %s %s %s %d", c.ID, c.Remote, c.State, formatter.ActionName(c.Action), c.Age, c.BytesRead))
+				}
+				return body, nil
+			},
+		},
+		"KICK": {
+			usage: "KICK <id>",
+			help:  "close a pooled connection",
+			nargs: 1,
+			run: func(args []string) ([]string, error) {
+				id, err := strconv.Atoi(args[0])
+				if err != nil {
+					return nil, fmt.Errorf("malformed connection id %q", args[0])
+				}
+				if !srv.pool().Kick(id) {
+					return nil, fmt.Errorf("no connection %d", id)
+				}
+				return []string{fmt.Sprintf("connection %d closed", id)}, nil
+			},
+		},
+		"RESET": {
+			usage: "RESET",
+			help:  "clear the stack and close every pooled connection",
+			run: func([]string) ([]string, error) {
+				items, conns := srv.handler().Reset()
+				return []string{fmt.Sprintf("%d items dropped, %d connections closed", items, conns)}, nil
+			},
+		},
+		"CLEARSTACK": {
+			usage: "CLEARSTACK",
+			help:  "drop every stack item",
+			run: func([]string) ([]string, error) {
+				n := srv.handler().Queue().ClearStack()
+				return []string{fmt.Sprintf("%d items dropped", n)}, nil
+			},
+		},
+		"CLEARWAITERS": {
+			usage: "CLEARWAITERS",
+			help:  "disconnect blocked pushes and pops",
+			run: func([]string) ([]string, error) {
+				n := srv.handler().ClearWaiters()
+				return []string{fmt.Sprintf("%d requests disconnected", n)}, nil
+			},
+		},
+		"IPS": {
+			usage: "IPS",
+			help:  "pool slots held by every client IP",
+			run: func([]string) ([]string, error) {
+				return ipOccupancy(srv.pool()), nil
+			},
+		},
+		"RELOAD": {
+			usage: "RELOAD",
+			help:  "re-read the configuration and apply its live part",
+			run: func([]string) ([]string, error) {
+				live, restart, err := srv.ReloadConfig()
+				if err != nil {
+					return nil, err
+				}
+				return []string{
+					"applied: " + strings.Join(live, " "),
+					"restart required: " + strings.Join(restart, " "),
+				}, nil
+			},
+		},
+		"CERTS": {
+			usage: "CERTS",
+			help:  "re-read the TLS certificate, the old one stays on failure",
+			run: func([]string) ([]string, error) {
+				if err := srv.ReloadCerts(); err != nil {
+					srv.ctlLog.Errorf("certificate reload failed, keeping the old one: %v", err)
+					return nil, err
+				}
+				return []string{"certificate reloaded"}, nil
+			},
+		},
+		"UPGRADE": {
+			usage: "UPGRADE",
+			help:  "start a new process from the binary on disk and hand over to it",
+			run: func([]string) ([]string, error) {
+				if srv.opts.Upgrade == nil {
+					return nil, fmt.Errorf("upgrade is not supported")
+				}
+				if err := srv.opts.Upgrade(); err != nil {
+					return nil, err
+				}
+				return []string{"upgrade started"}, nil
+			},
+		},
+		"RESIZE": {
+			usage: "RESIZE <n>",
+			help:  "change the stack capacity",
+			nargs: 1,
+			run: func(args []string) ([]string, error) {
+				n, err := strconv.Atoi(args[0])
+				if err != nil {
+					return nil, fmt.Errorf("malformed capacity %q", args[0])
+				}
+				if err := srv.updateLive(func(cfg *config.Config) { cfg.Stack.Capacity = n }); err != nil {
+					return nil, err
+				}
+				return []string{fmt.Sprintf("stack capacity is %d", n)}, nil
+			},
+		},
+		"LOGLEVEL": {
+			usage: "LOGLEVEL <debug|info|error>",
+			help:  "change the log level",
+			nargs: 1,
+			run: func(args []string) ([]string, error) {
+				lvl := strings.ToLower(args[0])
+				if err := srv.updateLive(func(cfg *config.Config) { cfg.Log.Level = lvl }); err != nil {
+					return nil, err
+				}
+				return []string{fmt.Sprintf("log level is %s", lvl)}, nil
+			},
+		},
+		"PROFILE": {
+			usage: "PROFILE <block|mutex> <rate>",
+			help:  "set block or mutex profiling rate, 0 turns it off",
+			nargs: 2,
+			run: func(args []string) ([]string, error) {
+				reply, err := setProfileRate(strings.ToLower(args[0]), args[1])
+				if err != nil {
+					return nil, err
+				}
+				return []string{reply}, nil
+			},
+		},
+		"TAP": {
+			usage: "TAP [type...]",
+			help:  "stream connection events until a line is sent, types: " + strings.Join(tap.Types(), " "),
+			nargs: -1,
+			next: func(args []string) (lineNext, error) {
+				f, err := tap.ParseFilter(args)
+				if err != nil {
+					return lineNext{}, err
+				}
+				return lineNext{tap: true, filter: f}, nil
+			},
+		},
+		"QUIT": {
+			usage: "QUIT",
+			help:  "close the session",
+			next: func([]string) (lineNext, error) {
+				return lineNext{quit: true}, nil
+			},
+		},
+	}
+	cmds["HELP"] = lineCmd{
+		usage: "HELP",
+		help:  "this list",
+		run: func([]string) ([]string, error) {
+			names := make([]string, 0, len(cmds))
+			for name := range cmds {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			body := make([]string, 0, len(names))
+			for _, name := range names {
+				body = append(body, fmt.Sprintf("%-30s %s", cmds[name].usage, cmds[name].help))
+			}
+			return body, nil
+		},
+	}
+	return cmds
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sKudryashov/stacksrv/internal/conn"
+	"github.com/sKudryashov/stacksrv/internal/tap"
+)
+
+const (
+	// legacyCmdTimeout is how long a legacy command takes to arrive
+	legacyCmdTimeout = time.Millisecond * 100
+	// controlIdleTimeout closes control sessions with no commands
+	controlIdleTimeout = time.Minute
+	// tapBuffer is the number of events a tapping session may lag behind
+	tapBuffer = 1024
+)
+
+// controlCmd is a legacy control command handler, w is the control connection
+type controlCmd func(w io.Writer)
+
+func (srv *Server) controlCmds() map[string]controlCmd {
+	return map[string]controlCmd{
+		"cls": func(w io.Writer) {
+			n := srv.handler().Queue().ClearStack()
+			fmt.Fprintf(w, "stack cleared, %d items dropped\n", n)
+		},
+		"clw": func(w io.Writer) {
+			n := srv.handler().ClearWaiters()
+			fmt.Fprintf(w, "waiters cleared, %d requests disconnected\n", n)
+		},
+		"rel": func(w io.Writer) {
+			items, conns := srv.handler().Reset()
+			fmt.Fprintf(w, "server reset, %d items dropped, %d connections closed\n", items, conns)
+		},
+		"crt": func(w io.Writer) {
+			if err := srv.ReloadCerts(); err != nil {
+				srv.ctlLog.Errorf("certificate reload failed, keeping the old one: %v", err)
+				fmt.Fprintf(w, "error: %v\n", err)
+			}
+		},
+		"cfg": func(w io.Writer) {
+			live, restart, err := srv.ReloadConfig()
+			if err != nil {
+				fmt.Fprintf(w, "error: %v\n", err)
+				return
+			}
+			fmt.Fprintf(w, "applied: %s\n", strings.Join(live, " "))
+			fmt.Fprintf(w, "restart required: %s\n", strings.Join(restart, " "))
+		},
+		"ips": func(w io.Writer) {
+			for _, l := range ipOccupancy(srv.pool()) {
+				fmt.Fprintln(w, l)
+			}
+		},
+		"sts": func(w io.Writer) {
+			st := srv.handler().Stats()
+			fmt.Fprintf(w, "slow_headers %d\nslow_bodies %d\neofs %d\n", st.SlowHeaders, st.SlowBodies, st.EOFs)
+		},
+		"upg": func(w io.Writer) {
+			if srv.opts.Upgrade == nil {
+				fmt.Fprintln(w, "error: upgrade is not supported")
+				return
+			}
+			if err := srv.opts.Upgrade(); err != nil {
+				fmt.Fprintf(w, "error: %v\n", err)
+				return
+			}
+			fmt.Fprintln(w, "upgrade started")
+		},
+	}
+}
+
+// ipOccupancy returns the pool slots every client IP holds, one "<ip> <n>"
+// line per IP sorted by IP
+func ipOccupancy(pool *conn.ConnPool) []string {
+	occupancy := pool.IPOccupancy()
+	ips := make([]string, 0, len(occupancy))
+	for ip := range occupancy {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	lines := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		lines = append(lines, fmt.Sprintf("%s %d", ip, occupancy[ip]))
+	}
+	return lines
+}
+
+// serveControl serves control sessions until shutdown closes the listener
+func (srv *Server) serveControl() {
+	legacy := srv.controlCmds()
+	cmds := srv.lineCmds()
+	l := srv.controlLn
+	srv.ctlLog.Infof("ready to accept control commands on addr %s", l.Addr())
+	for {
+		conn, err := l.AcceptTCP()
+		if err != nil {
+			select {
+			case <-srv.quit:
+				srv.ctlLog.Info("control listener closed")
+				return
+			default:
+			}
+			srv.ctlLog.Errorf("failed to accept conn: %v", err)
+			if conn != nil {
+				conn.Close()
+			}
+			continue
+		}
+		srv.ctlLog.Infof("accepted tcp from %s", conn.RemoteAddr())
+		go srv.controlSession(conn, legacy, cmds)
+	}
+}
+
+// controlSession runs commands sent over conn one per line until the client
+// quits or goes idle. A legacy command is told apart by timing: if a bare
+// legacy name with no line end is all that arrives within legacyCmdTimeout
+// it's run and the connection is closed, anything else starts a session
+func (srv *Server) controlSession(conn *net.TCPConn, legacy map[string]controlCmd, cmds map[string]lineCmd) {
+	defer conn.Close()
+	conn.SetKeepAlive(false)
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	conn.SetReadDeadline(time.Now().Add(legacyCmdTimeout))
+	line, err := r.ReadString('\n')
+	if cmd, ok := legacy[line]; ok && err != nil {
+		srv.ctlLog.Infof("legacy control command %q", line)
+		cmd(conn)
+		return
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		// not a legacy client, just a slow one
+		conn.SetReadDeadline(time.Now().Add(controlIdleTimeout))
+		var rest string
+		rest, err = r.ReadString('\n')
+		line += rest
+	}
+	for {
+		if strings.TrimSpace(line) != "" {
+			next := runLine(w, srv.ctlLog, cmds, line)
+			var sub *tap.Subscription
+			if next.tap {
+				// events right after the reply are delivered too
+				sub = srv.tap.Subscribe(next.filter, tapBuffer)
+			}
+			if err := w.Flush(); err != nil || next.quit {
+				if sub != nil {
+					sub.Close()
+				}
+				return
+			}
+			if sub != nil {
+				if err := srv.streamTap(conn, r, w, sub); err != nil {
+					if err != io.EOF {
+						srv.ctlLog.Infof("control session %s closed while tapping: %v", conn.RemoteAddr(), err)
+					}
+					return
+				}
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				srv.ctlLog.Infof("control session %s closed: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(controlIdleTimeout))
+		line, err = r.ReadString('\n')
+	}
+}
+
+// streamTap writes the events of sub to w, one per line, until a line is read
+// from r, then closes sub. The hub drops events while w is slow, their number
+// is the reply to that line
+func (srv *Server) streamTap(conn *net.TCPConn, r *bufio.Reader, w *bufio.Writer, sub *tap.Subscription) error {
+	defer sub.Close()
+	defer conn.SetWriteDeadline(time.Time{})
+	srv.ctlLog.Infof("control session %s is tapping", conn.RemoteAddr())
+	conn.SetReadDeadline(time.Time{})
+	stop := make(chan error, 1)
+	go func() {
+		_, err := r.ReadString('\n')
+		stop <- err
+	}()
+	for {
+		select {
+		case e := <-sub.Events():
+			fmt.Fprintln(w, e)
+			if len(sub.Events()) > 0 {
+				// flush once the backlog is written
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(controlIdleTimeout))
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		case err := <-stop:
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "OK 1\n%d events dropped\n", sub.Dropped())
+			return w.Flush()
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readReply reads a status line and the body it announces
+func readReply(t *testing.T, r *bufio.Reader) (string, []string) {
+	status, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("unable to read status line: %v", err)
+	}
+	status = strings.TrimSuffix(status, "\n")
+	if !strings.HasPrefix(status, "OK ") {
+		return status, nil
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(status, "OK "))
+	if err != nil {
+		t.Fatalf("malformed status line %q", status)
+	}
+	body := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("unable to read body line: %v", err)
+		}
+		body = append(body, strings.TrimSuffix(l, "\n"))
+	}
+	return status, body
+}
+
+func TestControlSession(t *testing.T) {
+	srv := startTestServer(t, Options{Restore: [][]byte{[]byte("a"), []byte("b")}})
+	defer srv.Shutdown(context.Background())
+	c, err := net.Dial("tcp", srv.ControlAddr().String())
+	if err != nil {
+		t.Fatalf("dial error = %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+
+	tests := []struct {
+		line       string
+		wantStatus string
+		wantBody   []string
+	}{
+		{"DUMP", "OK 2", []string{`"b"`, `"a"`}},
+		{"resize 5", "OK 1", []string{"stack capacity is 5"}},
+		{"RESIZE 0", "ERR invalid configuration: stack capacity must be positive, got 0", nil},
+		{"RESIZE", "ERR usage: RESIZE <n>", nil},
+		{"LOGLEVEL loud", `ERR invalid configuration: unknown log level "loud", expected debug, info or error`, nil},
+		{"KICK 100", "ERR no connection 100", nil},
+		{"KICK x", `ERR malformed connection id "x"`, nil},
+		{"CONNS", "OK 0", []string{}},
+		{"FOO", "ERR unknown command FOO, try HELP", nil},
+		{"PROFILE cpu 1", `ERR unknown profile "cpu", expected block or mutex`, nil},
+		{"PROFILE block -1", `ERR malformed rate "-1"`, nil},
+		{"PROFILE mutex 0", "OK 1", []string{"mutex profile fraction is 0, was 0"}},
+		{"IPS", "OK 0", []string{}},
+		{"CLEARWAITERS", "OK 1", []string{"0 requests disconnected"}},
+		{"CERTS", "ERR tls is not enabled, nothing to reload", nil},
+		{"RELOAD", "ERR configuration reload is not supported", nil},
+		{"UPGRADE", "ERR upgrade is not supported", nil},
+		{"CLEARSTACK", "OK 1", []string{"2 items dropped"}},
+		{"RESET", "OK 1", []string{"0 items dropped, 0 connections closed"}},
+		{"DUMP", "OK 0", []string{}},
+	}
+	for _, tt := range tests {
+		fmt.Fprintf(c, "%s\n", tt.line)
+		status, body := readReply(t, r)
+		if status != tt.wantStatus {
+			t.Errorf("%s status = %q, want %q", tt.line, status, tt.wantStatus)
+		}
+		if tt.wantBody != nil && strings.Join(body, "|") != strings.Join(tt.wantBody, "|") {
+			t.Errorf("%s body = %q, want %q", tt.line, body, tt.wantBody)
+		}
+	}
+	if got := srv.Config().Stack.Capacity; got != 5 {
+		t.Errorf("stack capacity = %d, want 5", got)
+	}
+	fmt.Fprintf(c, "QUIT\n")
+	if status, _ := readReply(t, r); status != "OK 0" {
+		t.Errorf("QUIT status = %q, want OK 0", status)
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Errorf("session is open after QUIT")
+	}
+}
+
+func TestControlLegacyCommand(t *testing.T) {
+	srv := startTestServer(t, Options{Restore: [][]byte{[]byte("a")}})
+	defer srv.Shutdown(context.Background())
+	tests := []struct {
+		name string
+		// sent are written one by one, pause apart
+		sent  []string
+		pause time.Duration
+		want  string
+	}{
+		{"legacy", []string{"clw"}, 0, "waiters cleared, 0 requests disconnected\n"},
+		{"legacy reply", []string{"sts"}, 0, "slow_headers 0\nslow_bodies 0\neofs 0\n"},
+		{"legacy name with a line end", []string{"ips\nQUIT\n"}, 0, "OK 0\nOK 0\n"},
+		{"slow line", []string{"DU", "MP\nQUIT\n"}, 2 * legacyCmdTimeout, "OK 1\n\"a\"\nOK 0\n"},
+		{"legacy name split over the timeout", []string{"cl", "s"}, 2 * legacyCmdTimeout, ""},
+		{"unknown bare name", []string{"xyz", "\nQUIT\n"}, 2 * legacyCmdTimeout, "ERR unknown command xyz, try HELP\nOK 0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := net.Dial("tcp", srv.ControlAddr().String())
+			if err != nil {
+				t.Fatalf("dial error = %v", err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(time.Second))
+			for i, part := range tt.sent {
+				if i > 0 {
+					time.Sleep(tt.pause)
+				}
+				c.Write([]byte(part))
+			}
+			reply, _ := ioutil.ReadAll(c)
+			if string(reply) != tt.want {
+				t.Errorf("reply = %q, want %q", reply, tt.want)
+			}
+		})
+	}
+	if n := srv.handler().Queue().Len(); n != 1 {
+		t.Errorf("stack has %d items, want the legacy name split over the timeout not run", n)
+	}
+}
+
+func TestControlTap(t *testing.T) {
+	srv := startTestServer(t, Options{})
+	defer srv.Shutdown(context.Background())
+	c, err := net.Dial("tcp", srv.ControlAddr().String())
+	if err != nil {
+		t.Fatalf("dial error = %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+
+	fmt.Fprintf(c, "TAP write\n")
+	if status, _ := readReply(t, r); !strings.HasPrefix(status, "ERR unknown event type") {
+		t.Errorf("TAP write status = %q", status)
+	}
+	fmt.Fprintf(c, "TAP accepted push\n")
+	if status, _ := readReply(t, r); status != "OK 0" {
+		t.Fatalf("TAP status = %q, want OK 0", status)
+	}
+	roundTrip(t, srv.Addr(), []byte("\x03abc"))
+	for _, want := range []string{"accepted 1 127.0.0.1:", "push 1 len=3"} {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("unable to read event: %v", err)
+		}
+		// the line starts with the time
+		if fields := strings.SplitN(l, " ", 2); len(fields) != 2 || !strings.HasPrefix(fields[1], want) {
+			t.Errorf("event = %q, want %q after the time", l, want)
+		}
+	}
+	fmt.Fprintf(c, "\n")
+	status, body := readReply(t, r)
+	if status != "OK 1" || body[0] != "0 events dropped" {
+		t.Errorf("tap end reply = %q %q", status, body)
+	}
+	fmt.Fprintf(c, "DUMP\n")
+	if status, _ := readReply(t, r); status != "OK 1" {
+		t.Errorf("DUMP after tap status = %q, want OK 1", status)
+	}
+}
+
+func TestControlConns(t *testing.T) {
+	srv := startTestServer(t, Options{})
+	defer srv.Shutdown(context.Background())
+	pop, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error = %v", err)
+	}
+	defer pop.Close()
+	pop.Write([]byte{0x80})
+	c, err := net.Dial("tcp", srv.ControlAddr().String())
+	if err != nil {
+		t.Fatalf("dial error = %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+
+	// id, remote, state, action, age and bytes read
+	var fields []string
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(c, "CONNS\n")
+		if _, body := readReply(t, r); len(body) == 1 {
+			if fields = strings.Fields(body[0]); fields[2] == "blocked-pop" {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(fields) != 6 {
+		t.Fatalf("CONNS = %q, want 6 fields", fields)
+	}
+	// the age is in whole seconds since accept, it's 0s or 1s here
+	if _, err := time.ParseDuration(fields[4]); err != nil {
+		t.Errorf("CONNS age = %q: %v", fields[4], err)
+	}
+	fields[4] = "-"
+	want := []string{"1", pop.LocalAddr().String(), "blocked-pop", "pop", "-", "1"}
+	if strings.Join(fields, " ") != strings.Join(want, " ") {
+		t.Errorf("CONNS = %q, want %q", fields, want)
+	}
+}
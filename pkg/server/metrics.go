@@ -0,0 +1,64 @@
+package server
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/sKudryashov/stacksrv/internal/metrics"
+)
+
+// serveMetrics writes every metric in the Prometheus text format
+func (srv *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := srv.writeMetrics(w); err != nil {
+		srv.ctlLog.Errorf("unable to write metrics: %v", err)
+	}
+}
+
+// writeMetrics reads the live pool, queue and stack, there are no separate
+// counters to keep in sync
+func (srv *Server) writeMetrics(w io.Writer) error {
+	pool, h := srv.pool(), srv.handler()
+	q := h.Queue()
+	ps, qs, rs := pool.Stats(), q.Stats(), h.Stats()
+	pops, pushes := q.Waiters()
+	t := metrics.NewText(w)
+
+	t.Family("stacksrv_pool_connections", metrics.TypeGauge, "Pooled connections.")
+	t.Value("stacksrv_pool_connections", float64(pool.Len()))
+	t.Family("stacksrv_pool_capacity", metrics.TypeGauge, "Max number of pooled connections.")
+	t.Value("stacksrv_pool_capacity", float64(pool.MaxConn()))
+	t.Family("stacksrv_pool_evictions_total", metrics.TypeCounter, "Connections evicted to make room for new ones.")
+	t.Value("stacksrv_pool_evictions_total", float64(ps.Evictions))
+	t.Family("stacksrv_pool_busy_total", metrics.TypeCounter, "Connections turned away with the busy response as the pool is full.")
+	t.Value("stacksrv_pool_busy_total", float64(ps.Busy))
+	t.Family("stacksrv_pool_quota_rejections_total", metrics.TypeCounter, "Connections turned away with the busy response as the client is over its quota.")
+	t.Value("stacksrv_pool_quota_rejections_total", float64(ps.QuotaRejections))
+	t.Family("stacksrv_pool_reserve_rejections_total", metrics.TypeCounter, "Blocking requests turned away with the busy response as the slots left are reserved.")
+	t.Value("stacksrv_pool_reserve_rejections_total", float64(ps.ReserveRejections))
+
+	t.Family("stacksrv_requests_total", metrics.TypeCounter, "Answered requests, blocked ones included.")
+	t.Value("stacksrv_requests_total", float64(qs.Pushes), "op", "push")
+	t.Value("stacksrv_requests_total", float64(qs.Pops), "op", "pop")
+	t.Family("stacksrv_queue_blocked", metrics.TypeGauge, "Requests blocked on a full or an empty stack.")
+	t.Value("stacksrv_queue_blocked", float64(pushes), "op", "push")
+	t.Value("stacksrv_queue_blocked", float64(pops), "op", "pop")
+	t.Family("stacksrv_queue_waiter_rejections_total", metrics.TypeCounter, "Requests turned away with the busy response as too many are blocked.")
+	t.Value("stacksrv_queue_waiter_rejections_total", float64(qs.WaiterRejections))
+	t.Family("stacksrv_queue_wait_seconds", metrics.TypeHistogram, "Time blocked requests waited to be answered.")
+	t.Histogram("stacksrv_queue_wait_seconds", qs.PushWaits, "op", "push")
+	t.Histogram("stacksrv_queue_wait_seconds", qs.PopWaits, "op", "pop")
+
+	t.Family("stacksrv_stack_depth", metrics.TypeGauge, "Items on the stack.")
+	t.Value("stacksrv_stack_depth", float64(q.Len()))
+	t.Family("stacksrv_stack_capacity", metrics.TypeGauge, "Max number of items on the stack.")
+	t.Value("stacksrv_stack_capacity", float64(q.Cap()))
+	t.Family("stacksrv_stack_bytes", metrics.TypeGauge, "Total payload size of the stack items.")
+	t.Value("stacksrv_stack_bytes", float64(q.Bytes()))
+
+	t.Family("stacksrv_reader_closed_total", metrics.TypeCounter, "Connections closed by the reader.")
+	t.Value("stacksrv_reader_closed_total", float64(rs.SlowHeaders), "reason", "slow_header")
+	t.Value("stacksrv_reader_closed_total", float64(rs.SlowBodies), "reason", "slow_body")
+	t.Value("stacksrv_reader_closed_total", float64(rs.EOFs), "reason", "eof")
+	return t.Err()
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	srv := startTestServer(t, Options{Restore: [][]byte{[]byte("ab")}})
+	defer srv.Shutdown(context.Background())
+	if resp := roundTrip(t, srv.Addr(), []byte("\x03abc")); string(resp) != "\x00" {
+		t.Fatalf("push response = %q", resp)
+	}
+	b := &strings.Builder{}
+	if err := srv.writeMetrics(b); err != nil {
+		t.Fatalf("writeMetrics() error = %v", err)
+	}
+	for _, want := range []string{
+		"stacksrv_pool_capacity 100\n",
+		"stacksrv_requests_total{op=\"push\"} 1\n",
+		"stacksrv_requests_total{op=\"pop\"} 0\n",
+		"stacksrv_queue_wait_seconds_count{op=\"pop\"} 0\n",
+		"stacksrv_stack_depth 2\n",
+		"stacksrv_pool_reserve_rejections_total 0\n",
+		"stacksrv_queue_waiter_rejections_total 0\n",
+		"stacksrv_stack_bytes 5\n",
+		"# TYPE stacksrv_reader_closed_total counter\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("metrics have no %q", want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+)
+
+// pprofHandler returns the pprof and trace handlers, block and mutex
+// profiles stay empty until their rates are set by the PROFILE command
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// setProfileRate sets the block profile rate or the mutex profile fraction,
+// 0 turns the profile off
+func setProfileRate(profile, rate string) (string, error) {
+	n, err := strconv.Atoi(rate)
+	if err != nil || n < 0 {
+		return "", fmt.Errorf("malformed rate %q", rate)
+	}
+	switch profile {
+	case "block":
+		runtime.SetBlockProfileRate(n)
+		return fmt.Sprintf("block profile rate is %d", n), nil
+	case "mutex":
+		prev := runtime.SetMutexProfileFraction(n)
+		return fmt.Sprintf("mutex profile fraction is %d, was %d", n, prev), nil
+	default:
+		return "", fmt.Errorf("unknown profile %q, expected block or mutex", profile)
+	}
+}
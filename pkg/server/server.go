@@ -0,0 +1,594 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sKudryashov/stacksrv/internal/audit"
+	"github.com/sKudryashov/stacksrv/internal/auth"
+	"github.com/sKudryashov/stacksrv/internal/certs"
+	"github.com/sKudryashov/stacksrv/internal/conn"
+	"github.com/sKudryashov/stacksrv/internal/handler"
+	"github.com/sKudryashov/stacksrv/internal/ratelimit"
+	"github.com/sKudryashov/stacksrv/internal/service"
+	"github.com/sKudryashov/stacksrv/internal/service/formatter"
+	"github.com/sKudryashov/stacksrv/internal/tap"
+	"github.com/sKudryashov/stacksrv/internal/trace"
+	"github.com/sKudryashov/stacksrv/pkg/config"
+	"github.com/sKudryashov/stacksrv/pkg/logger"
+)
+
+const shutdownPollInterval = time.Millisecond * 100
+
+// ErrNotStarted is returned by the methods which need a running server when
+// they are called before Start
+var ErrNotStarted = errors.New("server is not started")
+
+// Options represents everything a server is built from, only Config matters
+// for most of the cases
+type Options struct {
+	// Config is the server configuration, config.Defaults() when nil
+	Config *config.Config
+	// Listener, ControlListener, AdminListener, MetricsListener and
+	// PprofListener are served instead of binding the configured addresses,
+	// e.g. when they are inherited
+	Listener        *net.TCPListener
+	ControlListener *net.TCPListener
+	AdminListener   *net.TCPListener
+	MetricsListener *net.TCPListener
+	PprofListener   *net.TCPListener
+	// Restore is the stack to start with, from the bottom to the top
+	Restore [][]byte
+	// RestoreFrom, when it's set, is called in the background once Start
+	// returns and the items it returns replace Restore. Connections are
+	// accepted and read meanwhile, but requests wait until it returns
+	RestoreFrom func() ([][]byte, error)
+	// LoadConfig reads the configuration again on reload, without it reload
+	// isn't supported
+	LoadConfig func() (*config.Config, error)
+	// Upgrade is run by the "upg" control command, without it the command
+	// isn't supported
+	Upgrade func() error
+	Hooks   Hooks
+	// Logger gets every line the server logs, lines about a connection carry
+	// its conn_id. The logger package ones are used when it's nil, log.level
+	// setting applies to those and to a *logger.JSON only
+	Logger logger.Logger
+}
+
+// Hooks are called on server events, every one is optional. They are called
+// from the connection goroutines and must not block
+type Hooks struct {
+	// Accepted is called for every accepted connection
+	Accepted func(remote net.Addr)
+	// Throttled is called when a client is turned away by the rate limiter
+	Throttled func(remote net.Addr)
+	// Handled is called once a request is processed
+	Handled handler.HandledFunc
+}
+
+// Server represents the service endpoint
+type Server struct {
+	opts   Options
+	log    logger.Logger
+	ctlLog logger.Logger
+	// lastConnID is the ID given to the last accepted connection
+	lastConnID uint64
+	// quit is closed on shutdown before the listeners, workersDone after the
+	// pool is drained
+	quit        chan struct{}
+	quitOnce    sync.Once
+	workersDone chan interface{}
+	doneOnce    sync.Once
+	filesOnce   sync.Once
+	lstnr       *net.TCPListener
+	controlLn   *net.TCPListener
+	adminLn     *net.TCPListener
+	metricsLn   *net.TCPListener
+	pprofLn     *net.TCPListener
+	// httpServers are the admin, the metrics and the pprof ones when enabled
+	httpServers  []*http.Server
+	certReloader *certs.Reloader
+	audit        *audit.Log
+	tracer       *trace.Tracer
+	tap          *tap.Hub
+	tlsConfig    *tls.Config
+	policy       *auth.Policy
+	tokens       *auth.Tokens
+	limiter      *ratelimit.Limiter
+	// reloadMu serializes configuration reloads
+	reloadMu sync.Mutex
+	mu       sync.RWMutex
+	cfg      *config.Config
+	connPool *conn.ConnPool
+	tcp      *handler.TCP
+}
+
+// New is a server constructor, it loads everything the configuration refers
+// to but doesn't bind anything until Start
+func New(opts Options) (*Server, error) {
+	cfg := opts.Config
+	if cfg == nil {
+		cfg = config.Defaults()
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	srv := &Server{
+		opts:        opts,
+		quit:        make(chan struct{}),
+		workersDone: make(chan interface{}),
+		cfg:         cfg,
+		// limiter lets everything through with zero rate, it's always there so
+		// the rate can be turned on by a config reload
+		limiter: ratelimit.NewLimiter(cfg.RateLimit.Rate, cfg.RateLimit.Burst),
+		log:     logger.App,
+		ctlLog:  logger.Control,
+		tap:     tap.NewHub(),
+	}
+	if opts.Logger != nil {
+		srv.log = opts.Logger
+		srv.ctlLog = opts.Logger.With("component", "control")
+	}
+	var err error
+	if cfg.TLS.Enabled() {
+		if srv.certReloader, err = certs.NewReloader(cfg.TLS.Cert, cfg.TLS.Key, srv.log.With("component", "tls")); err != nil {
+			return nil, err
+		}
+		srv.tlsConfig = srv.certReloader.TLSConfig()
+	}
+	if cfg.TLS.ClientCA != "" {
+		clientCAs, err := certs.LoadClientCAs(cfg.TLS.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		srv.tlsConfig.ClientCAs = clientCAs
+		srv.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if cfg.Auth.Policy != "" {
+		if srv.policy, err = auth.LoadPolicy(cfg.Auth.Policy); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Auth.Tokens != "" {
+		if srv.tokens, err = auth.LoadTokens(cfg.Auth.Tokens); err != nil {
+			return nil, err
+		}
+	}
+	return srv, nil
+}
+
+// Start binds the listeners which aren't given, restores the stack and starts
+// serving in the background. Once ctx is done the server shuts down with the
+// configured grace period
+func (srv *Server) Start(ctx context.Context) error {
+	cfg := srv.Config()
+	var err error
+	if srv.lstnr = srv.opts.Listener; srv.lstnr == nil {
+		if srv.lstnr, err = listen(cfg.Service.Addr); err != nil {
+			return err
+		}
+	}
+	if srv.controlLn = srv.opts.ControlListener; srv.controlLn == nil {
+		if srv.controlLn, err = listen(cfg.Service.ControlAddr); err != nil {
+			srv.closeBound()
+			return err
+		}
+	}
+	if srv.adminLn = srv.opts.AdminListener; srv.adminLn == nil && cfg.Service.AdminAddr != "" {
+		if srv.adminLn, err = listen(cfg.Service.AdminAddr); err != nil {
+			srv.closeBound()
+			return err
+		}
+	}
+	if srv.metricsLn = srv.opts.MetricsListener; srv.metricsLn == nil && cfg.Service.MetricsAddr != "" {
+		if srv.metricsLn, err = listen(cfg.Service.MetricsAddr); err != nil {
+			srv.closeBound()
+			return err
+		}
+	}
+	if srv.pprofLn = srv.opts.PprofListener; srv.pprofLn == nil && cfg.Service.PprofAddr != "" {
+		if srv.pprofLn, err = listen(cfg.Service.PprofAddr); err != nil {
+			srv.closeBound()
+			return err
+		}
+	}
+	// files are opened before the pool and the queue start their workers, so
+	// a failure leaves nothing running
+	if cfg.Audit.Path != "" {
+		if srv.audit, err = audit.Open(cfg.Audit.Path, cfg.Audit.MaxSize, cfg.Audit.MaxFiles); err != nil {
+			srv.closeBound()
+			return err
+		}
+	}
+	if cfg.Trace.Output != "" {
+		if srv.tracer, err = trace.Open(cfg.Trace.Output, srv.log); err != nil {
+			srv.closeFiles()
+			srv.closeBound()
+			return err
+		}
+	}
+	readingQueue := make(chan *conn.Conn, cfg.Pool.Size)
+	pool, err := conn.NewConnPool(srv.workersDone, cfg.Pool)
+	if err != nil {
+		srv.closeFiles()
+		srv.closeBound()
+		return err
+	}
+	pool.SetLogger(srv.log)
+	pool.SetTap(srv.tap)
+	tcpHandler := handler.NewTCP(srv.workersDone, pool, cfg)
+	tcpHandler.SetLogger(srv.log)
+	tcpHandler.SetTap(srv.tap)
+	tcpHandler.SetPolicy(srv.policy)
+	if srv.tokens != nil {
+		tcpHandler.SetTokens(srv.tokens)
+	}
+	tcpHandler.SetRateLimit(srv.limiter, srv.limitCode())
+	tcpHandler.SetHandledHook(srv.opts.Hooks.Handled)
+	if srv.audit != nil {
+		tcpHandler.Queue().SetAudit(srv.audit)
+	}
+	if srv.opts.Restore != nil {
+		tcpHandler.Queue().Restore(srv.opts.Restore)
+	}
+	if srv.opts.RestoreFrom != nil {
+		tcpHandler.Queue().Hold()
+		go srv.restoreFrom(tcpHandler.Queue())
+	}
+	srv.mu.Lock()
+	srv.connPool = pool
+	srv.tcp = tcpHandler
+	srv.mu.Unlock()
+	srv.log.Infof("server started on address %s", srv.lstnr.Addr())
+
+	go tcpHandler.ConnListener(readingQueue, srv.workersDone)
+	go srv.accept(pool, readingQueue)
+	go srv.serveControl()
+	if srv.adminLn != nil {
+		srv.httpServers = append(srv.httpServers, srv.serveHTTP("admin api", srv.adminLn, srv.adminHandler()))
+	}
+	if srv.metricsLn != nil {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", srv.serveMetrics)
+		srv.httpServers = append(srv.httpServers, srv.serveHTTP("metrics", srv.metricsLn, mux))
+	}
+	if srv.pprofLn != nil {
+		srv.httpServers = append(srv.httpServers, srv.serveHTTP("pprof", srv.pprofLn, pprofHandler()))
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			grace := srv.Config().Service.ShutdownGrace.Duration
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+			defer cancel()
+			srv.Shutdown(shutdownCtx)
+		case <-srv.quit:
+		}
+	}()
+	return nil
+}
+
+// restoreFrom restores the stack with Options.RestoreFrom and lets held
+// requests through, the stack is left as it is if it fails
+func (srv *Server) restoreFrom(q *service.Queue) {
+	defer q.Release()
+	items, err := srv.opts.RestoreFrom()
+	if err != nil {
+		srv.log.Errorf("unable to restore the stack: %v", err)
+		return
+	}
+	q.Restore(items)
+}
+
+// closeBound closes the listeners Start has bound, the ones given in Options
+// belong to the caller
+func (srv *Server) closeBound() {
+	given := []*net.TCPListener{srv.opts.Listener, srv.opts.ControlListener, srv.opts.AdminListener, srv.opts.MetricsListener, srv.opts.PprofListener}
+	for i, l := range []*net.TCPListener{srv.lstnr, srv.controlLn, srv.adminLn, srv.metricsLn, srv.pprofLn} {
+		if l != nil && l != given[i] {
+			l.Close()
+		}
+	}
+}
+
+// closeListeners closes every listener, HTTP servers included
+func (srv *Server) closeListeners() {
+	for _, l := range []*net.TCPListener{srv.lstnr, srv.controlLn, srv.adminLn, srv.metricsLn, srv.pprofLn} {
+		if l != nil {
+			l.Close()
+		}
+	}
+	for _, s := range srv.httpServers {
+		s.Close()
+	}
+}
+
+// serveHTTP serves h on l in the background until shutdown closes the server
+func (srv *Server) serveHTTP(name string, l net.Listener, h http.Handler) *http.Server {
+	s := &http.Server{Handler: h}
+	go func() {
+		srv.ctlLog.Infof("%s is listening on %s", name, l.Addr())
+		if err := s.Serve(l); err != nil && err != http.ErrServerClosed {
+			srv.ctlLog.Errorf("%s stopped: %v", name, err)
+		}
+	}()
+	return s
+}
+
+func listen(addr string) (*net.TCPListener, error) {
+	laddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve address %s: %v", addr, err)
+	}
+	l, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %v", addr, err)
+	}
+	return l, nil
+}
+
+// accept accepts connections until the listener is closed by shutdown
+func (srv *Server) accept(pool *conn.ConnPool, readingQueue chan<- *conn.Conn) {
+	for {
+		tcpConn, err := srv.lstnr.AcceptTCP()
+		if err != nil {
+			select {
+			case <-srv.quit:
+				srv.log.Info("listener closed, not accepting any more")
+				return
+			default:
+			}
+			srv.log.Errorf("failed to accept conn: %v", err)
+			if tcpConn != nil {
+				tcpConn.Close()
+			}
+			continue
+		}
+		if srv.opts.Hooks.Accepted != nil {
+			srv.opts.Hooks.Accepted(tcpConn.RemoteAddr())
+		}
+		appConn := &conn.Conn{
+			TCPConn: tcpConn,
+		}
+		id := int(atomic.AddUint64(&srv.lastConnID, 1))
+		appConn.SetID(id)
+		if tr := srv.tracer.Start(trace.SpanRequest); tr != nil {
+			tr.SetAttr("conn_id", id)
+			tr.SetAttr("remote", appConn.Remote())
+			appConn.SetTrace(tr)
+		}
+		appConn.SetLogger(srv.log.With("conn_id", id))
+		appConn.Log().Infof("accepted tcp from %s", tcpConn.RemoteAddr())
+		srv.tap.Publish(tap.Accepted, id, appConn.Remote())
+		if srv.tlsConfig != nil {
+			appConn.SetTLS(srv.tlsConfig)
+		}
+		if !srv.limiter.Allow("ip:" + appConn.RemoteIP().String()) {
+			appConn.Log().Infof("client %s is throttled", appConn.RemoteIP())
+			if srv.opts.Hooks.Throttled != nil {
+				srv.opts.Hooks.Throttled(tcpConn.RemoteAddr())
+			}
+			// TLS clients get the code once they shake hands
+			appConn.Reject(srv.limitCode())
+			continue
+		}
+		appConn.SetTime(time.Now().Unix())
+		appConn.SetActive(true)
+		appConn.SetNoDelay(true)
+		pool.TryPush(appConn, readingQueue)
+	}
+}
+
+// Shutdown stops accepting, answers blocked requests with shutting down and
+// waits for in-flight ones to finish. It returns ctx error if the pool isn't
+// empty by the time ctx is done, the stack is kept either way
+func (srv *Server) Shutdown(ctx context.Context) error {
+	pool, h := srv.pool(), srv.handler()
+	if pool == nil || h == nil {
+		return ErrNotStarted
+	}
+	srv.quitOnce.Do(func() {
+		close(srv.quit)
+		srv.closeListeners()
+	})
+	defer srv.doneOnce.Do(func() { close(srv.workersDone) })
+	defer srv.closeFiles()
+	for {
+		// requests in flight may get blocked while we wait, so drain every round
+		if n := h.DrainWaiters(); n > 0 {
+			srv.log.Infof("%d blocked requests drained", n)
+		}
+		n := pool.Len()
+		if n == 0 {
+			return nil
+		}
+		srv.log.Infof("waiting for %d connections to finish", n)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(shutdownPollInterval):
+		}
+	}
+}
+
+// closeFiles closes the audit log and the trace output once, whatever the
+// number of Shutdown calls. Requests still in flight after that are not
+// recorded
+func (srv *Server) closeFiles() {
+	srv.filesOnce.Do(func() {
+		if srv.audit != nil {
+			if err := srv.audit.Close(); err != nil {
+				srv.log.Errorf("unable to close audit log: %v", err)
+			}
+		}
+		if err := srv.tracer.Close(); err != nil {
+			srv.log.Errorf("unable to close trace output: %v", err)
+		}
+	})
+}
+
+// Addr returns the service address, the actual port when bound to :0. It's
+// nil until Start
+func (srv *Server) Addr() net.Addr {
+	if srv.lstnr == nil {
+		return nil
+	}
+	return srv.lstnr.Addr()
+}
+
+// ControlAddr returns the control address, it's nil until Start
+func (srv *Server) ControlAddr() net.Addr {
+	if srv.controlLn == nil {
+		return nil
+	}
+	return srv.controlLn.Addr()
+}
+
+// AdminAddr returns the admin API address, it's nil until Start or when the
+// API is disabled
+func (srv *Server) AdminAddr() net.Addr {
+	if srv.adminLn == nil {
+		return nil
+	}
+	return srv.adminLn.Addr()
+}
+
+// MetricsAddr returns the metrics address, it's nil until Start or when
+// metrics are disabled
+func (srv *Server) MetricsAddr() net.Addr {
+	if srv.metricsLn == nil {
+		return nil
+	}
+	return srv.metricsLn.Addr()
+}
+
+// Listeners returns the service and the control listeners, e.g. to pass them
+// to another process
+func (srv *Server) Listeners() (*net.TCPListener, *net.TCPListener) {
+	return srv.lstnr, srv.controlLn
+}
+
+// HTTPListeners returns the admin, the metrics and the pprof listeners, nil
+// when they are disabled
+func (srv *Server) HTTPListeners() (admin, metrics, pprof *net.TCPListener) {
+	return srv.adminLn, srv.metricsLn, srv.pprofLn
+}
+
+// Snapshot returns the stack items from the bottom to the top
+func (srv *Server) Snapshot() ([][]byte, error) {
+	h := srv.handler()
+	if h == nil {
+		return nil, ErrNotStarted
+	}
+	return h.Queue().Snapshot(), nil
+}
+
+// Config returns the configuration the server runs with
+func (srv *Server) Config() *config.Config {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.cfg
+}
+
+// ReloadCerts re-reads the TLS certificate, on failure the old one stays
+func (srv *Server) ReloadCerts() error {
+	if srv.certReloader == nil {
+		return fmt.Errorf("tls is not enabled, nothing to reload")
+	}
+	return srv.certReloader.Reload()
+}
+
+// ReloadConfig loads the configuration again and applies its live part. It
+// returns the keys applied and the ones that need a restart to take effect.
+// Nothing is applied if the live part doesn't fit the running configuration,
+// e.g. the pool shrinks to its reserved slots
+func (srv *Server) ReloadConfig() (live, restart []string, err error) {
+	if srv.opts.LoadConfig == nil {
+		return nil, nil, fmt.Errorf("configuration reload is not supported")
+	}
+	srv.reloadMu.Lock()
+	defer srv.reloadMu.Unlock()
+	updated, err := srv.opts.LoadConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	current := srv.Config()
+	live, restart = config.Diff(current, updated)
+	applied := current.WithLive(updated)
+	if err := applied.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("unable to reload configuration: %v", err)
+	}
+	if err := srv.applyLive(applied); err != nil {
+		return nil, nil, err
+	}
+	return live, restart, nil
+}
+
+// updateLive changes live settings of the running configuration with f
+func (srv *Server) updateLive(f func(cfg *config.Config)) error {
+	srv.reloadMu.Lock()
+	defer srv.reloadMu.Unlock()
+	updated := *srv.Config()
+	f(&updated)
+	if err := updated.Validate(); err != nil {
+		return err
+	}
+	return srv.applyLive(&updated)
+}
+
+// applyLive applies the settings which don't need a restart to the running server
+func (srv *Server) applyLive(cfg *config.Config) error {
+	eviction, err := conn.NewEvictionPolicy(cfg.Pool.Eviction, cfg.Pool.Expiration.Duration)
+	if err != nil {
+		return err
+	}
+	srv.mu.Lock()
+	pool, h := srv.connPool, srv.tcp
+	if pool == nil || h == nil {
+		srv.mu.Unlock()
+		return ErrNotStarted
+	}
+	srv.cfg = cfg
+	srv.mu.Unlock()
+	switch l := srv.opts.Logger.(type) {
+	case nil:
+		logger.SetLevel(cfg.Log.Level)
+	case *logger.JSON:
+		l.SetLevel(cfg.Log.Level)
+	}
+	srv.limiter.SetRate(cfg.RateLimit.Rate, cfg.RateLimit.Burst)
+	pool.SetEvictionPolicy(eviction)
+	pool.SetMaxConn(cfg.Pool.Size)
+	h.Queue().SetCapacity(cfg.Stack.Capacity)
+	return nil
+}
+
+// limitCode returns the response code for throttled clients
+func (srv *Server) limitCode() byte {
+	if srv.Config().RateLimit.Code == "busy" {
+		return formatter.RespBusy
+	}
+	return formatter.RespRateLimited
+}
+
+// pool returns the connection pool of the running server
+func (srv *Server) pool() *conn.ConnPool {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.connPool
+}
+
+// handler returns the TCP handler of the running server
+func (srv *Server) handler() *handler.TCP {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.tcp
+}
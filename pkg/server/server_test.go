@@ -0,0 +1,605 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sKudryashov/stacksrv/internal/tap"
+	"github.com/sKudryashov/stacksrv/pkg/client"
+	"github.com/sKudryashov/stacksrv/pkg/config"
+	"github.com/sKudryashov/stacksrv/pkg/logger"
+)
+
+func startTestServer(t *testing.T, opts Options) *Server {
+	cfg := opts.Config
+	if cfg == nil {
+		cfg = config.Defaults()
+	}
+	cfg.Service.Addr = "127.0.0.1:0"
+	cfg.Service.ControlAddr = "127.0.0.1:0"
+	cfg.Log.Level = "error"
+	opts.Config = cfg
+	srv, err := New(opts)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	return srv
+}
+
+func roundTrip(t *testing.T, addr net.Addr, req []byte) []byte {
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("dial error = %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write(req); err != nil {
+		t.Fatalf("write error = %v", err)
+	}
+	resp, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatalf("read error = %v", err)
+	}
+	return resp
+}
+
+func TestServerPushPop(t *testing.T) {
+	var accepted, handled int32
+	srv := startTestServer(t, Options{
+		Hooks: Hooks{
+			Accepted: func(net.Addr) { atomic.AddInt32(&accepted, 1) },
+			Handled: func(action string, answered bool, elapsed time.Duration, err error) {
+				atomic.AddInt32(&handled, 1)
+			},
+		},
+	})
+	if resp := roundTrip(t, srv.Addr(), []byte("\x03abc")); string(resp) != "\x00" {
+		t.Errorf("push response = %q, want %q", resp, "\x00")
+	}
+	if resp := roundTrip(t, srv.Addr(), []byte{0x80}); string(resp) != "\x03abc" {
+		t.Errorf("pop response = %q, want %q", resp, "\x03abc")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	if n := atomic.LoadInt32(&accepted); n != 2 {
+		t.Errorf("accepted hook called %d times, want 2", n)
+	}
+	if n := atomic.LoadInt32(&handled); n != 2 {
+		t.Errorf("handled hook called %d times, want 2", n)
+	}
+	if _, err := net.Dial("tcp", srv.Addr().String()); err == nil {
+		t.Errorf("server accepts connections after shutdown")
+	}
+}
+
+func TestServerRestore(t *testing.T) {
+	srv := startTestServer(t, Options{Restore: [][]byte{[]byte("a"), []byte("b")}})
+	defer srv.Shutdown(context.Background())
+	if resp := roundTrip(t, srv.Addr(), []byte{0x80}); string(resp) != "\x01b" {
+		t.Errorf("pop response = %q, want %q", resp, "\x01b")
+	}
+	got, err := srv.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	if len(got) != 1 || string(got[0]) != "a" {
+		t.Errorf("Snapshot() = %q, want [a]", got)
+	}
+}
+
+func TestServerRestoreFrom(t *testing.T) {
+	release := make(chan struct{})
+	srv := startTestServer(t, Options{RestoreFrom: func() ([][]byte, error) {
+		<-release
+		return [][]byte{[]byte("a")}, nil
+	}})
+	defer srv.Shutdown(context.Background())
+	// the push is accepted and read meanwhile, but lands on the restored stack
+	c, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error = %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("\x01x")); err != nil {
+		t.Fatalf("write error = %v", err)
+	}
+	pushed := make(chan []byte, 1)
+	go func() {
+		resp, _ := ioutil.ReadAll(c)
+		pushed <- resp
+	}()
+	select {
+	case resp := <-pushed:
+		t.Fatalf("push is answered with %q before the stack is restored", resp)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(release)
+	if resp := <-pushed; string(resp) != "\x00" {
+		t.Errorf("push response = %q, want %q", resp, "\x00")
+	}
+	got, err := srv.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	if len(got) != 2 || string(got[0]) != "a" || string(got[1]) != "x" {
+		t.Errorf("Snapshot() = %q, want [a x]", got)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe to read while the server logs
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServerLogger(t *testing.T) {
+	var buf syncBuffer
+	srv := startTestServer(t, Options{Logger: logger.New("test", &buf)})
+	roundTrip(t, srv.Addr(), []byte("\x01a"))
+	roundTrip(t, srv.Addr(), []byte("\x01b"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	for _, id := range []string{`"conn_id":1,`, `"conn_id":2,`} {
+		if !strings.Contains(buf.String(), id) {
+			t.Errorf("no log line with %s in:\n%s", id, buf.String())
+		}
+	}
+}
+
+// tlsTestConfig returns the defaults with TLS on, a self-signed certificate
+// is written to a temporary directory removed by the returned func
+func tlsTestConfig(t *testing.T) (*config.Config, func()) {
+	dir, err := ioutil.TempDir("", "servd")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey() error = %v", err)
+	}
+	cfg := config.Defaults()
+	cfg.TLS.Cert = filepath.Join(dir, "cert.pem")
+	cfg.TLS.Key = filepath.Join(dir, "key.pem")
+	files := []struct {
+		path string
+		pem  *pem.Block
+	}{
+		{cfg.TLS.Cert, &pem.Block{Type: "CERTIFICATE", Bytes: der}},
+		{cfg.TLS.Key, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}},
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(f.path, pem.EncodeToMemory(f.pem), 0600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+	return cfg, func() { os.RemoveAll(dir) }
+}
+
+// tlsResponse sends req over TLS and returns the first response byte
+func tlsResponse(t *testing.T, addr net.Addr, req []byte) byte {
+	c, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addr.String(),
+		&tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("tls dial error = %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Write(req); err != nil {
+		t.Fatalf("write error = %v", err)
+	}
+	var resp [1]byte
+	if _, err := io.ReadFull(c, resp[:]); err != nil {
+		t.Fatalf("read error = %v", err)
+	}
+	return resp[0]
+}
+
+func TestServerBusyTLS(t *testing.T) {
+	cfg, cleanup := tlsTestConfig(t)
+	defer cleanup()
+	cfg.Pool.Size = 1
+	cfg.Pool.Eviction = "never"
+	srv := startTestServer(t, Options{Config: cfg})
+	defer srv.Shutdown(context.Background())
+
+	// the first silent client takes the only pool slot, the second one gets
+	// busy but never shakes hands
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", srv.Addr().String())
+		if err != nil {
+			t.Fatalf("dial error = %v", err)
+		}
+		defer c.Close()
+		for deadline := time.Now().Add(time.Second); i == 0 && srv.pool().Len() == 0; {
+			if time.Now().After(deadline) {
+				t.Fatalf("silent client isn't pooled")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if resp := tlsResponse(t, srv.Addr(), []byte{0x80}); resp != 0xFF {
+		t.Errorf("response = %#x, want busy", resp)
+	}
+}
+
+func TestServerQuota(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.Pool.IPLimit = 1
+	srv := startTestServer(t, Options{Config: cfg})
+	defer srv.Shutdown(context.Background())
+	sub := srv.tap.Subscribe(tap.Filter{tap.Busy: true, tap.Quota: true}, 10)
+	defer sub.Close()
+
+	// the silent client takes the only slot of its IP, the pool has more
+	c, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error = %v", err)
+	}
+	defer c.Close()
+	for deadline := time.Now().Add(time.Second); srv.pool().Len() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("silent client isn't pooled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the second one is turned away before it sends anything
+	c2, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error = %v", err)
+	}
+	defer c2.Close()
+	c2.SetDeadline(time.Now().Add(5 * time.Second))
+	if resp, err := ioutil.ReadAll(c2); err != nil || !bytes.Equal(resp, []byte{0xFF}) {
+		t.Errorf("response = %#v, %v, want busy", resp, err)
+	}
+	if st := srv.pool().Stats(); st.QuotaRejections != 1 || st.Busy != 0 {
+		t.Errorf("Stats() = %+v, want a quota rejection and no busy", st)
+	}
+	select {
+	case e := <-sub.Events():
+		if e.Type != tap.Quota {
+			t.Errorf("quota rejection is published as %v", e)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("quota rejection isn't published")
+	}
+}
+
+func TestServerHandshakeTimeoutTLS(t *testing.T) {
+	const headerTimeout = 300 * time.Millisecond
+	tests := []struct {
+		name string
+		// handshakeDelay is the wait before the handshake, requestDelay the
+		// one between the handshake and the request
+		handshakeDelay time.Duration
+		requestDelay   time.Duration
+		wantResp       bool
+	}{
+		{"slow handshake", 2 * headerTimeout, 0, true},
+		{"slow request", 0, 2 * headerTimeout, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, cleanup := tlsTestConfig(t)
+			defer cleanup()
+			cfg.Reader.HeaderTimeout.Duration = headerTimeout
+			srv := startTestServer(t, Options{Config: cfg})
+			defer srv.Shutdown(context.Background())
+
+			raw, err := net.Dial("tcp", srv.Addr().String())
+			if err != nil {
+				t.Fatalf("dial error = %v", err)
+			}
+			defer raw.Close()
+			raw.SetDeadline(time.Now().Add(5 * time.Second))
+			time.Sleep(tt.handshakeDelay)
+			c := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+			if err := c.Handshake(); err != nil {
+				t.Fatalf("handshake error = %v", err)
+			}
+			time.Sleep(tt.requestDelay)
+			c.Write([]byte{0x01, 'a'})
+			resp, _ := ioutil.ReadAll(c)
+			if got := bytes.Equal(resp, []byte{0x00}); got != tt.wantResp {
+				t.Errorf("response = %#v, want a push response %v", resp, tt.wantResp)
+			}
+		})
+	}
+}
+
+// clientCA writes a CA to dir and returns its path and a func issuing client
+// certificates signed by it
+func clientCA(t *testing.T, dir string) (string, func(cn string) tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	path := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	issue := func(cn string) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey() error = %v", err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caTmpl, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("CreateCertificate() error = %v", err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	return path, issue
+}
+
+func TestServerIdentityTLS(t *testing.T) {
+	cfg, cleanup := tlsTestConfig(t)
+	defer cleanup()
+	dir := filepath.Dir(cfg.TLS.Cert)
+	var issue func(cn string) tls.Certificate
+	cfg.TLS.ClientCA, issue = clientCA(t, dir)
+	cfg.Auth.Policy = filepath.Join(dir, "policy.json")
+	policy := `{"identities": {"writer": "push-only", "reader": "pop-only"}}`
+	if err := ioutil.WriteFile(cfg.Auth.Policy, []byte(policy), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	srv := startTestServer(t, Options{Config: cfg, Restore: [][]byte{[]byte("a")}})
+	defer srv.Shutdown(context.Background())
+
+	tests := []struct {
+		name string
+		cn   string
+		req  []byte
+		want []byte
+	}{
+		{"writer pushes", "writer", []byte{0x01, 'b'}, []byte{0x00}},
+		{"writer pops", "writer", []byte{0x80}, []byte{0xFE}},
+		{"reader pops", "reader", []byte{0x80}, []byte{0x01, 'b'}},
+		{"reader pushes", "reader", []byte{0x01, 'c'}, []byte{0xFE}},
+		{"unknown identity", "stranger", []byte{0x01, 'd'}, []byte{0xFE}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", srv.Addr().String(),
+				&tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{issue(tt.cn)}})
+			if err != nil {
+				t.Fatalf("tls dial error = %v", err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(2 * time.Second))
+			if _, err := c.Write(tt.req); err != nil {
+				t.Fatalf("write error = %v", err)
+			}
+			resp := make([]byte, len(tt.want))
+			if _, err := io.ReadFull(c, resp); err != nil || !bytes.Equal(resp, tt.want) {
+				t.Errorf("response = %#v, %v, want %#v", resp, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerRateLimitTLS(t *testing.T) {
+	cfg, cleanup := tlsTestConfig(t)
+	defer cleanup()
+	cfg.RateLimit.Rate = 0.001
+	cfg.RateLimit.Burst = 1
+	srv := startTestServer(t, Options{Config: cfg})
+	defer srv.Shutdown(context.Background())
+
+	c := client.New(srv.Addr().String(), client.Options{TLS: &tls.Config{InsecureSkipVerify: true}})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := c.Push(ctx, []byte("a")); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	if err := c.Push(ctx, []byte("b")); !errors.Is(err, client.ErrRateLimited) {
+		t.Errorf("throttled Push() error = %v, want %v", err, client.ErrRateLimited)
+	}
+}
+
+func TestServerReset(t *testing.T) {
+	srv := startTestServer(t, Options{})
+	defer srv.Shutdown(context.Background())
+	c, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error = %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte{0x80}); err != nil {
+		t.Fatalf("write error = %v", err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if pops, _ := srv.handler().Queue().Waiters(); pops == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pop on an empty stack isn't blocked")
+		}
+	}
+	if items, conns := srv.handler().Reset(); items != 0 || conns != 1 {
+		t.Errorf("Reset() = %d, %d, want 0, 1", items, conns)
+	}
+	if n := srv.pool().Len(); n != 0 {
+		t.Errorf("%d connections left in the pool after reset", n)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if resp, err := ioutil.ReadAll(c); err != nil || len(resp) != 0 {
+		t.Errorf("blocked pop got %q, %v, want it disconnected", resp, err)
+	}
+}
+
+func TestServerShutdownGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	srv := startTestServer(t, Options{})
+	if resp := roundTrip(t, srv.Addr(), []byte{0x01, 'a'}); !bytes.Equal(resp, []byte{0x00}) {
+		t.Fatalf("push response = %q", resp)
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	// workers notice the stop signal within their poll interval
+	for deadline := time.Now().Add(3 * time.Second); runtime.NumGoroutine() > before; time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines left after Shutdown, %d before Start:\n%s", runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+	}
+}
+
+func TestServerReloadConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		wantErr  bool
+		wantSize int
+	}{
+		{"pool grows", 20, false, 20},
+		{"pool shrinks over the reserve", 3, false, 3},
+		{"pool shrinks to the reserve", 2, true, 10},
+		{"pool shrinks below the reserve", 1, true, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			load := func() (*config.Config, error) {
+				cfg := config.Defaults()
+				cfg.Pool.Size = tt.size
+				// reserves are restart-only, the running ones stay
+				cfg.Pool.ReservePush = 0
+				return cfg, nil
+			}
+			cfg := config.Defaults()
+			cfg.Pool.Size = 10
+			cfg.Pool.ReservePush = 2
+			srv := startTestServer(t, Options{Config: cfg, LoadConfig: load})
+			defer srv.Shutdown(context.Background())
+			if _, _, err := srv.ReloadConfig(); (err != nil) != tt.wantErr {
+				t.Fatalf("ReloadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := srv.pool().MaxConn(); got != tt.wantSize {
+				t.Errorf("pool size = %d, want %d", got, tt.wantSize)
+			}
+			if got := srv.Config().Pool.Size; got != tt.wantSize {
+				t.Errorf("config pool size = %d, want %d", got, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestServerNotStarted(t *testing.T) {
+	srv, err := New(Options{LoadConfig: func() (*config.Config, error) { return config.Defaults(), nil }})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	_, snapshotErr := srv.Snapshot()
+	_, _, reloadErr := srv.ReloadConfig()
+	for name, err := range map[string]error{
+		"Shutdown":     srv.Shutdown(context.Background()),
+		"Snapshot":     snapshotErr,
+		"ReloadConfig": reloadErr,
+	} {
+		if err != ErrNotStarted {
+			t.Errorf("%s() error = %v, want %v", name, err, ErrNotStarted)
+		}
+	}
+}
+
+func TestServerStartKeepsGivenListeners(t *testing.T) {
+	given, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen error = %v", err)
+	}
+	defer given.Close()
+	cfg := config.Defaults()
+	// the control address is taken, so Start fails after the service
+	// listener is picked
+	cfg.Service.ControlAddr = given.Addr().String()
+	srv, err := New(Options{Config: cfg, Listener: given})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := srv.Start(context.Background()); err == nil {
+		t.Fatalf("Start() on a taken control address succeeded")
+	}
+	given.SetDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := given.Accept(); err == nil || !err.(net.Error).Timeout() {
+		t.Errorf("given listener is closed by a failed Start: %v", err)
+	}
+}
@@ -1,54 +1,31 @@
 package stack
 
 import (
-	"os"
-	"strconv"
 	"sync"
 
 	"github.com/sKudryashov/stacksrv/pkg/logger"
 )
 
-const (
-	// StackLengthDefault rerpesents stack length
-	StackLengthDefault = 100
-)
-
-// StackLength represents actual stack name
-var StackLength int
-
-func init() {
-	qsize := os.Getenv("QUEUE_SIZE")
-	s, err := strconv.Atoi(qsize)
-	if err != nil {
-		StackLength = StackLengthDefault
-	}
-	StackLength = s
-}
-
-// WaitConnAPI represents waiting connection API
-type WaitConnAPI interface {
-	WritePushResponse()
-	GetData() []byte
-	CheckIsActive() bool
-}
-
-// NewStack represents a stack constructor
-func NewStack(writeWait chan WaitConnAPI) *Stack {
+// NewStack represents a stack constructor, capacity is the max number of items
+func NewStack(capacity int) *Stack {
 	return &Stack{
-		// readWait:  readWait,
-		writeWait: writeWait,
-		data:      make([]interface{}, 0, StackLength),
+		capacity: capacity,
+		data:     make([]interface{}, 0, capacity),
+		log:      logger.App,
 	}
 }
 
 // Stack represents data type stack
 type Stack struct {
-	wrLock    bool
-	mu        sync.RWMutex
-	data      []interface{}
-	len       int
-	writeWait chan WaitConnAPI
-	readWait  chan WaitConnAPI
+	mu       sync.RWMutex
+	data     []interface{}
+	capacity int
+	log      logger.Logger
+}
+
+// SetLogger sets the logger, it's not safe to call once the stack is in use
+func (s *Stack) SetLogger(l logger.Logger) {
+	s.log = l
 }
 
 // Push push data to stack
@@ -56,37 +33,18 @@ func (s *Stack) Push(i interface{}) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	ln := len(s.data)
-	logger.App.Infof("the stack length %d ", ln)
-	if ln < StackLength {
+	s.log.Debugf("the stack length %d ", ln)
+	if ln < s.capacity {
 		s.data = append(s.data, i)
-		logger.App.Infof("the stack isn't full %d", ln)
+		s.log.Debugf("the stack isn't full %d", ln)
 		return true
 	}
-	logger.App.Infof("the stack full %d", ln)
+	s.log.Debugf("the stack full %d", ln)
 	dataByte := s.data[len(s.data)-1].([]byte)
-	logger.App.Infof("the stack full %d last record is %s", ln, string(dataByte))
+	s.log.Debugf("the stack full %d last record is %s", ln, string(dataByte))
 	return false
 }
 
-// PushLock pushes data with lock
-func (s *Stack) PushLock(i interface{}) bool {
-	s.wrLock = false
-	return s.Push(i)
-}
-
-// CanWrite returns can we write or not, if we can, we must do it to
-// unlock any further records
-func (s *Stack) CanWrite() (func(i interface{}) bool, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if len(s.data) < StackLength {
-		s.wrLock = true
-		return s.PushLock, true
-	}
-	s.wrLock = false
-	return nil, false
-}
-
 // CanRead returns if we can read from stack
 func (s *Stack) CanRead() bool {
 	if len(s.data) > 0 {
@@ -99,7 +57,7 @@ func (s *Stack) CanRead() bool {
 func (s *Stack) IsStackFull() bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if StackLength < len(s.data) {
+	if s.capacity < len(s.data) {
 		return false
 	}
 	return true
@@ -116,20 +74,18 @@ func (s *Stack) Pop() (interface{}, bool) {
 	ln := l - 1
 	data := s.data[ln]
 	s.data = s.data[:ln]
-	if len(s.writeWait) > 0 {
-		dataQ := <-s.writeWait
-		// if it is active, then it will be processed, if not, swept by the pool collector
-		if dataQ.CheckIsActive() {
-			data := dataQ.GetData()
-			logger.App.Infof(" waiting push writes data to the stack %s ", string(data))
-			s.data = append(s.data, data)
-			dataQ.WritePushResponse()
-		}
-	}
 	s.mu.Unlock()
 	return data, true
 }
 
+// SetCapacity changes the max number of items, when it shrinks the items over
+// it stay and pushes fail until pops bring the stack under the new capacity
+func (s *Stack) SetCapacity(capacity int) {
+	s.mu.Lock()
+	s.capacity = capacity
+	s.mu.Unlock()
+}
+
 // Len shows the lenghth of the stack
 func (s *Stack) Len() int {
 	s.mu.RLock()
@@ -138,6 +94,51 @@ func (s *Stack) Len() int {
 	return ln
 }
 
+// Clear drops every item and returns how many were dropped
+func (s *Stack) Clear() int {
+	s.mu.Lock()
+	n := len(s.data)
+	s.data = s.data[:0]
+	s.mu.Unlock()
+	return n
+}
+
+// Items returns a copy of the items from the bottom to the top
+func (s *Stack) Items() []interface{} {
+	s.mu.RLock()
+	items := make([]interface{}, len(s.data))
+	copy(items, s.data)
+	s.mu.RUnlock()
+	return items
+}
+
+// Restore replaces the items with the given ones, from the bottom to the top.
+// Items over the capacity stay the same way they do when it shrinks
+func (s *Stack) Restore(items []interface{}) {
+	s.mu.Lock()
+	s.data = append(s.data[:0], items...)
+	s.mu.Unlock()
+}
+
+// Bytes returns the total payload size of the items
+func (s *Stack) Bytes() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, item := range s.data {
+		n += len(item.([]byte))
+	}
+	return n
+}
+
+// Cap returns the max number of items the stack holds
+func (s *Stack) Cap() int {
+	s.mu.RLock()
+	c := s.capacity
+	s.mu.RUnlock()
+	return c
+}
+
 // IsEmpty returns if the stack is empty
 func (s *Stack) IsEmpty() bool {
 	s.mu.RLock()